@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/leepro/buffy/proxy"
+)
+
+type Client struct {
+	Base    string
+	Token   string
+	User    string
+	Timeout time.Duration
+	JSON    bool
+}
+
+type upstreamStatus struct {
+	Id       string `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Handler  struct {
+		UpstreamStatus uint32 `json:"upstream_status"`
+		GateState      uint32 `json:"gate_state"`
+		InFlight       int32  `json:"in_flight"`
+		Gate           struct {
+			Actor     string     `json:"actor"`
+			Reason    string     `json:"reason,omitempty"`
+			ChangedAt time.Time  `json:"changed_at"`
+			ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		} `json:"gate"`
+	} `json:"handler"`
+}
+
+type endpointStatus struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	Handler struct {
+		MaxConn int    `json:"maxconn"`
+		CurConn int    `json:"curconn"`
+		Counter uint32 `json:"counter"`
+	} `json:"handler"`
+}
+
+type serverStatus struct {
+	Upstreams []upstreamStatus `json:"upstreams"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+type apiError struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+func (cl *Client) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, cl.Base+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cl.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cl.Token)
+	} else if cl.User != "" {
+		u, p := cl.User, ""
+		if i := strings.Index(u, ":"); i >= 0 {
+			u, p = cl.User[:i], cl.User[i+1:]
+		}
+		req.SetBasicAuth(u, p)
+	}
+
+	return req, nil
+}
+
+// do sends a request and returns the raw body of a successful response.
+func (cl *Client) do(method, path string, body interface{}) ([]byte, error) {
+	req, err := cl.newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := (&http.Client{Timeout: cl.Timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	bs, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		var ae apiError
+		if json.Unmarshal(bs, &ae) == nil && ae.Error != "" {
+			return nil, fmt.Errorf("%d: %s", res.StatusCode, ae.Error)
+		}
+		return nil, fmt.Errorf("%d: %s", res.StatusCode, strings.TrimSpace(string(bs)))
+	}
+
+	return bs, nil
+}
+
+func (cl *Client) fail(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	return ExitFailed
+}
+
+func (cl *Client) printJSON(bs []byte) {
+	var out bytes.Buffer
+	if json.Indent(&out, bs, "", "  ") != nil {
+		out.Write(bs)
+	}
+	fmt.Println(out.String())
+}
+
+func statusName(s uint32) string {
+	switch s {
+	case proxy.StatusUnavailable:
+		return "unavailable"
+	case proxy.StatusAvailable:
+		return "available"
+	}
+	return "none"
+}
+
+func gateName(g uint32) string {
+	if g == proxy.GateOpened {
+		return "opened"
+	}
+	return "closed"
+}
+
+func (cl *Client) status() (*serverStatus, []byte, error) {
+	bs, err := cl.do(http.MethodGet, "/v1/status", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var st serverStatus
+	if err := json.Unmarshal(bs, &st); err != nil {
+		return nil, nil, err
+	}
+
+	return &st, bs, nil
+}
+
+func (cl *Client) upstream(id string) (*upstreamStatus, error) {
+	bs, err := cl.do(http.MethodGet, "/v1/upstreams/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var us upstreamStatus
+	return &us, json.Unmarshal(bs, &us)
+}
+
+func (cl *Client) Status() int {
+	st, bs, err := cl.status()
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	if cl.JSON {
+		cl.printJSON(bs)
+		return ExitOK
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPSTREAM\tENDPOINT\tSTATUS\tGATE\tIN FLIGHT\tBY\tREASON\tEXPIRES")
+	for _, u := range st.Upstreams {
+		g := u.Handler.Gate
+		expires := "-"
+		if g.ExpiresAt != nil {
+			expires = g.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", u.Id, u.Endpoint, statusName(u.Handler.UpstreamStatus), gateName(u.Handler.GateState), u.Handler.InFlight, g.Actor, g.Reason, expires)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "ENDPOINT\tPATH\tQUEUE\tMAX\tREQUESTS")
+	for _, e := range st.Endpoints {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", e.Id, e.Path, e.Handler.CurConn, e.Handler.MaxConn, e.Handler.Counter)
+	}
+	tw.Flush()
+
+	return ExitOK
+}
+
+func (cl *Client) Gate(upstream, action, reason, ttl string) int {
+	body := map[string]string{"action": action, "reason": reason, "ttl": ttl}
+
+	bs, err := cl.do(http.MethodPost, "/v1/upstreams/"+upstream+"/gate", body)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	if cl.JSON {
+		cl.printJSON(bs)
+	} else {
+		fmt.Printf("%s: gate %s\n", upstream, action)
+	}
+
+	return ExitOK
+}
+
+// poll calls check every interval until it returns true, an error, or the
+// timeout elapses.
+func (cl *Client) poll(timeout, interval time.Duration, check func() (bool, error)) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := check()
+		if err != nil {
+			return cl.fail(err)
+		}
+		if ok {
+			return ExitOK
+		}
+
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "error: timeout after %s\n", timeout)
+			return ExitTimeout
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (cl *Client) Wait(upstream string, timeout, interval time.Duration) int {
+	var last *upstreamStatus
+
+	code := cl.poll(timeout, interval, func() (bool, error) {
+		us, err := cl.upstream(upstream)
+		if err != nil {
+			return false, err
+		}
+		last = us
+		return us.Handler.UpstreamStatus == proxy.StatusAvailable && us.Handler.GateState == proxy.GateOpened, nil
+	})
+
+	if code == ExitOK || code == ExitTimeout {
+		cl.printUpstream(last)
+	}
+
+	return code
+}
+
+func (cl *Client) Drain(upstream string, timeout, interval time.Duration) int {
+	if _, err := cl.do(http.MethodPost, "/v1/upstreams/"+upstream+"/drain", nil); err != nil {
+		return cl.fail(err)
+	}
+
+	var last *upstreamStatus
+
+	code := cl.poll(timeout, interval, func() (bool, error) {
+		us, err := cl.upstream(upstream)
+		if err != nil {
+			return false, err
+		}
+		last = us
+		return us.Handler.InFlight == 0, nil
+	})
+
+	if code == ExitOK || code == ExitTimeout {
+		cl.printUpstream(last)
+	}
+
+	return code
+}
+
+func (cl *Client) printUpstream(us *upstreamStatus) {
+	if us == nil {
+		return
+	}
+
+	if cl.JSON {
+		bs, _ := json.Marshal(us)
+		cl.printJSON(bs)
+		return
+	}
+
+	fmt.Printf("%s: status=%s gate=%s in_flight=%d by=%s reason=%q\n", us.Id, statusName(us.Handler.UpstreamStatus), gateName(us.Handler.GateState), us.Handler.InFlight, us.Handler.Gate.Actor, us.Handler.Gate.Reason)
+}
+
+func (cl *Client) Reload() int {
+	bs, err := cl.do(http.MethodPost, "/v1/reload", nil)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	if cl.JSON {
+		cl.printJSON(bs)
+	} else {
+		fmt.Println("reloaded")
+	}
+
+	return ExitOK
+}
+
+func (cl *Client) Events() int {
+	req, err := cl.newRequest(http.MethodGet, "/v1/events", nil)
+	if err != nil {
+		return cl.fail(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cl.fail(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(res.Body)
+		return cl.fail(fmt.Errorf("%d: %s", res.StatusCode, strings.TrimSpace(string(bs))))
+	}
+
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+
+		if cl.JSON {
+			fmt.Println(data)
+		} else {
+			fmt.Printf("%s %s\n", time.Now().Format(time.RFC3339), data)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return cl.fail(err)
+	}
+
+	return cl.fail(errors.New("event stream closed"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leepro/buffy/proxy"
+)
+
+// upstreamState returns the state of the upstream "api" at the n-th look.
+type upstreamState func(n int32) (status, gate uint32, inflight int32)
+
+// newTestClient serves the admin API used by the commands for the
+// upstream "api", and returns a client of it with the number of looks at
+// the upstream.
+func newTestClient(t *testing.T, state upstreamState) (*Client, *int32) {
+	var looks int32
+
+	upstream := func() map[string]interface{} {
+		status, gate, inflight := state(atomic.AddInt32(&looks, 1))
+		return map[string]interface{}{
+			"id":       "api",
+			"endpoint": "http://localhost:9091",
+			"handler": map[string]interface{}{
+				"upstream_status": status,
+				"gate_state":      gate,
+				"in_flight":       inflight,
+				"gate":            map[string]interface{}{"actor": "admin:test"},
+			},
+		}
+	}
+	write := func(w http.ResponseWriter, code int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_admin/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		write(w, http.StatusOK, map[string]interface{}{"upstreams": []interface{}{upstream()}})
+	})
+	mux.HandleFunc("/_admin/v1/upstreams/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_admin/v1/upstreams/api":
+			write(w, http.StatusOK, upstream())
+		case "/_admin/v1/upstreams/api/gate", "/_admin/v1/upstreams/api/drain":
+			write(w, http.StatusOK, map[string]string{"status": "ok"})
+		default:
+			write(w, http.StatusNotFound, map[string]interface{}{"code": http.StatusNotFound, "error": "not found upstream"})
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return &Client{Base: srv.URL + "/_admin", Timeout: time.Second}, &looks
+}
+
+func TestClientExitCodes(t *testing.T) {
+	cl, _ := newTestClient(t, func(n int32) (uint32, uint32, int32) {
+		return proxy.StatusAvailable, proxy.GateOpened, 0
+	})
+
+	for _, tt := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"status"}, ExitOK},
+		{[]string{"gate", "close", "api", "-reason", "deploy"}, ExitOK},
+		{[]string{"gate", "close", "nope"}, ExitFailed},
+		{[]string{"wait", "nope", "-timeout", "50ms"}, ExitFailed},
+		{[]string{}, ExitUsage},
+		{[]string{"gate", "toggle", "api"}, ExitUsage},
+		{[]string{"wait"}, ExitUsage},
+		{[]string{"wait", "api", "-timeout", "soon"}, ExitUsage},
+		{[]string{"unknown"}, ExitUsage},
+	} {
+		if code := run(cl, tt.args); code != tt.code {
+			t.Errorf("%v: got %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}
+
+func TestClientWait(t *testing.T) {
+	// available from the 3rd look, its gate opened from the 4th
+	cl, looks := newTestClient(t, func(n int32) (uint32, uint32, int32) {
+		status, gate := proxy.StatusUnavailable, proxy.GateClosed
+		if n >= 3 {
+			status = proxy.StatusAvailable
+		}
+		if n >= 4 {
+			gate = proxy.GateOpened
+		}
+		return status, gate, 0
+	})
+
+	if code := cl.Wait("api", time.Second, 10*time.Millisecond); code != ExitOK {
+		t.Errorf("wait: got %d", code)
+	}
+	if n := atomic.LoadInt32(looks); n != 4 {
+		t.Errorf("wait: %d looks, want 4", n)
+	}
+
+	// never ready
+	cl, _ = newTestClient(t, func(n int32) (uint32, uint32, int32) {
+		return proxy.StatusAvailable, proxy.GateClosed, 0
+	})
+	st := time.Now()
+	if code := cl.Wait("api", 50*time.Millisecond, 10*time.Millisecond); code != ExitTimeout {
+		t.Errorf("wait: got %d, want the timeout", code)
+	}
+	if d := time.Since(st); d < 50*time.Millisecond {
+		t.Errorf("timed out after %s only", d)
+	}
+}
+
+func TestClientDrain(t *testing.T) {
+	cl, looks := newTestClient(t, func(n int32) (uint32, uint32, int32) {
+		return proxy.StatusAvailable, proxy.GateClosed, 3 - n
+	})
+
+	if code := cl.Drain("api", time.Second, 10*time.Millisecond); code != ExitOK {
+		t.Errorf("drain: got %d", code)
+	}
+	if n := atomic.LoadInt32(looks); n != 3 {
+		t.Errorf("drain: %d looks, want 3", n)
+	}
+}
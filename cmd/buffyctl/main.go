@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// exit codes
+const (
+	ExitOK      = 0
+	ExitFailed  = 1
+	ExitUsage   = 2
+	ExitTimeout = 3
+)
+
+var (
+	// built-in
+	BuildVersion string
+
+	// arguments
+	addr    = flag.String("addr", envOr("BUFFY_ADDR", "http://localhost:7001"), "admin address (env BUFFY_ADDR)")
+	path    = flag.String("path", envOr("BUFFY_ADMIN_PATH", "/_admin"), "admin path (env BUFFY_ADMIN_PATH)")
+	token   = flag.String("token", os.Getenv("BUFFY_TOKEN"), "bearer token (env BUFFY_TOKEN)")
+	user    = flag.String("user", os.Getenv("BUFFY_USER"), "basic auth as user:password (env BUFFY_USER)")
+	output  = flag.String("o", "table", "output format: table or json")
+	reqTime = flag.Duration("request-timeout", 10*time.Second, "timeout of a single admin request")
+	version = flag.Bool("v", false, "version")
+)
+
+const usage = `usage: buffyctl [flags] <command> [args]
+
+commands:
+  status                             show upstreams and endpoints
+  gate open|close <upstream>         open or close the gate of an upstream [-reason text] [-ttl 30m]
+  wait <upstream> [-timeout 60s]     wait until the upstream is available and its gate is opened
+  drain <upstream> [-timeout 60s]    close the gate and wait until no request is in flight
+  reload                             reload upstreams and endpoints from the config file
+  events                             print events as they happen
+
+exit codes: 0 ok, 1 failed, 2 usage, 3 timeout
+
+flags:
+`
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("buffyctl build:%s\n", BuildVersion)
+		os.Exit(ExitOK)
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format: %s\n", *output)
+		os.Exit(ExitUsage)
+	}
+
+	cl := &Client{
+		Base:    strings.TrimSuffix(*addr, "/") + *path,
+		Token:   *token,
+		User:    *user,
+		Timeout: *reqTime,
+		JSON:    *output == "json",
+	}
+
+	os.Exit(run(cl, flag.Args()))
+}
+
+// run runs a command and returns its exit code.
+func run(cl *Client, args []string) int {
+	if len(args) == 0 {
+		flag.Usage()
+		return ExitUsage
+	}
+
+	switch args[0] {
+	case "status":
+		return cl.Status()
+	case "gate":
+		fs := flag.NewFlagSet("gate", flag.ContinueOnError)
+		reason := fs.String("reason", "", "why the gate is changed")
+		ttl := fs.String("ttl", "", "revert the change after this duration (e.g. 30m)")
+		if fs.Parse(args[1:]) != nil {
+			return ExitUsage
+		}
+		if fs.NArg() < 2 || (fs.Arg(0) != "open" && fs.Arg(0) != "close") {
+			fmt.Fprintln(os.Stderr, "usage: buffyctl gate open|close <upstream> [-reason text] [-ttl 30m]")
+			return ExitUsage
+		}
+		action, upstream := fs.Arg(0), fs.Arg(1)
+		if fs.Parse(fs.Args()[2:]) != nil {
+			return ExitUsage
+		}
+		return cl.Gate(upstream, action, *reason, *ttl)
+	case "wait", "drain":
+		fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		timeout := fs.Duration("timeout", 60*time.Second, "how long to wait")
+		interval := fs.Duration("interval", time.Second, "polling interval")
+		if fs.Parse(args[1:]) != nil {
+			return ExitUsage
+		}
+		if fs.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "usage: buffyctl %s <upstream> [-timeout 60s] [-interval 1s]\n", args[0])
+			return ExitUsage
+		}
+		// flags may also follow the upstream id
+		upstream := fs.Arg(0)
+		if fs.Parse(fs.Args()[1:]) != nil {
+			return ExitUsage
+		}
+		if args[0] == "wait" {
+			return cl.Wait(upstream, *timeout, *interval)
+		}
+		return cl.Drain(upstream, *timeout, *interval)
+	case "reload":
+		return cl.Reload()
+	case "events":
+		return cl.Events()
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+	flag.Usage()
+	return ExitUsage
+}
@@ -2,7 +2,14 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -10,8 +17,86 @@ const (
 	ActionClose = "close"
 )
 
+var (
+	ErrNotFoundUpstream = errors.New("not found upstream id")
+	ErrNotFoundEndpoint = errors.New("not found endpoint id")
+	ErrNoCache          = errors.New("endpoint without cache")
+	ErrNoQueue          = errors.New("endpoint without queue")
+	ErrInvalidAction    = errors.New("invalid action")
+)
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	bs, _ := json.Marshal(v)
+	w.Write(bs)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]interface{}{
+		"status": "error",
+		"code":   code,
+		"error":  msg,
+	})
+}
+
+// readJSON decodes a request body into v. An empty body leaves v untouched.
+func readJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (ps *ProxyServer) registerAdminRoutes(ar *AdminRouter) {
+	// legacy routes
+	ar.Handle("", "/config", RoleReadOnly, ps.AdminHandleConfig)
+	ar.Handle("", "/status", RoleReadOnly, ps.AdminHandleStatus)
+	ar.Handle("", "/gate", RoleOperator, ps.AdminHandleGate)
+	ar.HandleAbs(http.MethodGet, "/metrics", RoleReadOnly, ps.AdminHandleMetrics)
+
+	// v1
+	ar.Handle(http.MethodGet, "/v1/openapi.json", RoleReadOnly, ps.AdminHandleOpenAPI)
+	ar.Handle(http.MethodGet, "/v1/config", RoleReadOnly, ps.AdminHandleConfig)
+	ar.Handle(http.MethodGet, "/v1/status", RoleReadOnly, ps.AdminHandleStatus)
+	ar.Handle(http.MethodGet, "/v1/metrics", RoleReadOnly, ps.AdminHandleMetrics)
+	ar.Handle(http.MethodGet, "/v1/upstreams", RoleReadOnly, ps.AdminListUpstreams)
+	ar.Handle(http.MethodGet, "/v1/upstreams/{id}", RoleReadOnly, ps.AdminGetUpstream)
+	ar.Handle(http.MethodGet, "/v1/upstreams/{id}/gate", RoleReadOnly, ps.AdminGetGate)
+	ar.Handle(http.MethodPost, "/v1/upstreams/{id}/gate", RoleOperator, ps.AdminSetGate)
+	ar.Handle(http.MethodPut, "/v1/upstreams/{id}/gate", RoleOperator, ps.AdminSetGate)
+	ar.Handle(http.MethodPost, "/v1/upstreams", RoleOperator, ps.AdminCreateUpstream)
+	ar.Handle(http.MethodPut, "/v1/upstreams/{id}", RoleOperator, ps.AdminUpdateUpstream)
+	ar.Handle(http.MethodDelete, "/v1/upstreams/{id}", RoleOperator, ps.AdminDeleteUpstream)
+	ar.Handle(http.MethodGet, "/v1/endpoints", RoleReadOnly, ps.AdminListEndpoints)
+	ar.Handle(http.MethodGet, "/v1/endpoints/{id}", RoleReadOnly, ps.AdminGetEndpoint)
+	ar.Handle(http.MethodPost, "/v1/endpoints", RoleOperator, ps.AdminCreateEndpoint)
+	ar.Handle(http.MethodPut, "/v1/endpoints/{id}", RoleOperator, ps.AdminUpdateEndpoint)
+	ar.Handle(http.MethodDelete, "/v1/endpoints/{id}", RoleOperator, ps.AdminDeleteEndpoint)
+	ar.Handle(http.MethodGet, "/v1/endpoints/{id}/cache", RoleReadOnly, ps.AdminGetCache)
+	ar.Handle(http.MethodDelete, "/v1/endpoints/{id}/cache", RoleOperator, ps.AdminPurgeCache)
+	ar.Handle(http.MethodGet, "/v1/endpoints/{id}/rate_limit", RoleReadOnly, ps.AdminGetRateLimit)
+	ar.Handle(http.MethodPut, "/v1/endpoints/{id}/rate_limit", RoleOperator, ps.AdminSetRateLimit)
+	ar.Handle(http.MethodGet, "/v1/queue/{id}", RoleReadOnly, ps.AdminGetQueue)
+	ar.Handle(http.MethodPost, "/v1/queue/{id}/flush", RoleOperator, ps.AdminFlushQueue)
+	ar.Handle(http.MethodDelete, "/v1/queue/{id}/{request}", RoleOperator, ps.AdminCancelQueued)
+	ar.Handle(http.MethodPost, "/v1/queue/{id}/{request}/release", RoleOperator, ps.AdminReleaseQueued)
+	ar.Handle(http.MethodPost, "/v1/config/persist", RoleOperator, ps.AdminPersistConfig)
+	ar.Handle(http.MethodPost, "/v1/upstreams/{id}/drain", RoleOperator, ps.AdminDrainUpstream)
+	ar.Handle(http.MethodPost, "/v1/reload", RoleOperator, ps.AdminReload)
+	ar.Handle(http.MethodGet, "/v1/events", RoleReadOnly, ps.AdminEvents)
+	ar.Handle(http.MethodGet, "/v1/cluster", RoleReadOnly, ps.AdminClusterStatus)
+	ar.Handle(http.MethodPost, "/v1/cluster/sync", RolePeer, ps.AdminClusterSync)
+}
+
 func (ps *ProxyServer) AdminHandleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
+
+	ps.Lock()
+	defer ps.Unlock()
+
 	bs, _ := json.Marshal(ps.Cfg)
 	w.Write(bs)
 }
@@ -22,65 +107,555 @@ func (ps *ProxyServer) AdminHandleStatus(w http.ResponseWriter, r *http.Request)
 	ps.Lock()
 	defer ps.Unlock()
 
+	transitions := []Transition{}
+	now := time.Now()
+	for _, u := range ps.upstreams {
+		transitions = append(transitions, u.Transitions(now)...)
+	}
+	sort.Slice(transitions, func(i, j int) bool { return transitions[i].At.Before(transitions[j].At) })
+
 	ret := map[string]interface{}{
 		"server":    ps.Cfg.Server,
 		"upstreams": ps.upstreams,
 		"endpoints": ps.endpoints,
+		"schedule":  transitions,
 	}
 
 	bs, _ := json.Marshal(ret)
 	w.Write(bs)
 }
 
+// AdminHandleGate is the legacy `gate?upstream=<id>&action=<open|close>`
+// route, also accepting `reason` and `ttl`.
 func (ps *ProxyServer) AdminHandleGate(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-
 	upstreamId := r.URL.Query().Get("upstream")
 	action := r.URL.Query().Get("action")
 
 	if upstreamId == "" || action == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid parameters"))
+		writeJSONError(w, http.StatusBadRequest, "invalid parameters")
 		return
 	}
 
+	req := GateRequest{
+		Action: action,
+		Reason: r.URL.Query().Get("reason"),
+		TTL:    r.URL.Query().Get("ttl"),
+	}
+
+	if code, err := ps.controlGate(upstreamId, adminActor(r), req); err != nil {
+		writeJSONError(w, code, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "ok",
+		"upstream": upstreamId,
+		"action":   action,
+	})
+}
+
+// adminActor names the caller of an admin request for gate records.
+func adminActor(r *http.Request) string {
+	if p := principalFromRequest(r); p != nil {
+		return actorWithId(ActorAdmin, p.Name)
+	}
+	return ActorAdmin
+}
+
+func (ps *ProxyServer) controlGate(upstreamId, actor string, req GateRequest) (int, error) {
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			return http.StatusBadRequest, errors.New("invalid ttl: " + req.TTL)
+		}
+	}
+
 	ps.Lock()
 	defer ps.Unlock()
 
-	var u *Upstream
-	var err error
-
-	if u, err = ps.LookupUpstreamWithIds([]string{upstreamId}); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("not found upstream id"))
-		return
+	u, err := ps.LookupUpstreamWithIds([]string{upstreamId})
+	if err != nil {
+		return http.StatusNotFound, ErrNotFoundUpstream
 	}
 
-	switch action {
+	switch req.Action {
 	case ActionOpen:
-		if err := u.Opengate(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("failed to control the gate: " + err.Error()))
-			return
-		}
+		err = u.Opengate(actor, req.Reason, ttl)
 	case ActionClose:
-		if err := u.Closegate(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("failed to control the gate: " + err.Error()))
+		err = u.Closegate(actor, req.Reason, ttl)
+	default:
+		return http.StatusBadRequest, ErrInvalidAction
+	}
+
+	if err != nil {
+		return http.StatusBadRequest, errors.New("failed to control the gate: " + err.Error())
+	}
+
+	return http.StatusOK, nil
+}
+
+func (ps *ProxyServer) lookupUpstream(id string) *Upstream {
+	ps.Lock()
+	defer ps.Unlock()
+
+	u, _ := ps.LookupUpstreamWithIds([]string{id})
+	return u
+}
+
+func (ps *ProxyServer) lookupEndpoint(id string) *Endpoint {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, e := range ps.endpoints {
+		if e.Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (ps *ProxyServer) AdminListUpstreams(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"upstreams": ps.upstreams})
+}
+
+func (ps *ProxyServer) AdminGetUpstream(w http.ResponseWriter, r *http.Request) {
+	u := ps.lookupUpstream(adminParam(r, "id"))
+	if u == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundUpstream.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+func gateName(g uint32) string {
+	if g == GateOpened {
+		return "opened"
+	}
+	return "closed"
+}
+
+func (ps *ProxyServer) AdminGetGate(w http.ResponseWriter, r *http.Request) {
+	u := ps.lookupUpstream(adminParam(r, "id"))
+	if u == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundUpstream.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"upstream": u.Id,
+		"gate":     gateName(u.Handler.GetGateState()),
+		"change":   u.Handler.GateInfo(),
+	})
+}
+
+type GateRequest struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"`
+}
+
+// AdminSetGate opens or closes a gate with a body of
+// {"action": "open|close", "reason": "...", "ttl": "30m"}.
+func (ps *ProxyServer) AdminSetGate(w http.ResponseWriter, r *http.Request) {
+	id := adminParam(r, "id")
+
+	var req GateRequest
+	if err := readJSON(r, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	if code, err := ps.controlGate(id, adminActor(r), req); err != nil {
+		writeJSONError(w, code, err.Error())
+		return
+	}
+
+	// deleted in the meantime
+	u := ps.lookupUpstream(id)
+	if u == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundUpstream.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "ok",
+		"upstream": id,
+		"action":   req.Action,
+		"gate":     gateName(u.Handler.GetGateState()),
+		"change":   u.Handler.GateInfo(),
+	})
+}
+
+func (ps *ProxyServer) AdminListEndpoints(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"endpoints": ps.endpoints})
+}
+
+func (ps *ProxyServer) AdminGetEndpoint(w http.ResponseWriter, r *http.Request) {
+	e := ps.lookupEndpoint(adminParam(r, "id"))
+	if e == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundEndpoint.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, e)
+}
+
+// finishChange answers a runtime change and, when requested with
+// ?persist=true or enabled by `admin.persist`, saves it to the config file.
+func (ps *ProxyServer) finishChange(w http.ResponseWriter, r *http.Request, code int, err error, kind, id string) {
+	if err != nil {
+		writeJSONError(w, code, err.Error())
+		return
+	}
+
+	persist := ps.Cfg.Server.Admin.Persist
+	if v := r.URL.Query().Get("persist"); v != "" {
+		persist = v == "true" || v == "1"
+	}
+
+	if persist {
+		if err := ps.PersistConfig(); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "applied but failed to persist: "+err.Error())
 			return
 		}
-	default:
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid action"))
+	}
+
+	writeJSON(w, code, map[string]interface{}{
+		"status":    "ok",
+		kind:        id,
+		"persisted": persist,
+	})
+}
+
+func (ps *ProxyServer) AdminCreateUpstream(w http.ResponseWriter, r *http.Request) {
+	var def UpstreamDef
+	if err := readJSON(r, &def); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
 		return
 	}
 
-	ret := map[string]interface{}{
+	code, err := ps.AddUpstream(def)
+	ps.finishChange(w, r, code, err, "upstream", def.Id)
+}
+
+func (ps *ProxyServer) AdminUpdateUpstream(w http.ResponseWriter, r *http.Request) {
+	var def UpstreamDef
+	if err := readJSON(r, &def); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	id := adminParam(r, "id")
+	code, err := ps.UpdateUpstream(id, def)
+	ps.finishChange(w, r, code, err, "upstream", id)
+}
+
+func (ps *ProxyServer) AdminDeleteUpstream(w http.ResponseWriter, r *http.Request) {
+	id := adminParam(r, "id")
+	code, err := ps.DeleteUpstream(id)
+	ps.finishChange(w, r, code, err, "upstream", id)
+}
+
+func (ps *ProxyServer) AdminCreateEndpoint(w http.ResponseWriter, r *http.Request) {
+	var def EndpointDef
+	if err := readJSON(r, &def); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	code, err := ps.AddEndpoint(def)
+	ps.finishChange(w, r, code, err, "endpoint", def.Id)
+}
+
+func (ps *ProxyServer) AdminUpdateEndpoint(w http.ResponseWriter, r *http.Request) {
+	var def EndpointDef
+	if err := readJSON(r, &def); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	id := adminParam(r, "id")
+	code, err := ps.UpdateEndpoint(id, def)
+	ps.finishChange(w, r, code, err, "endpoint", id)
+}
+
+func (ps *ProxyServer) AdminDeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := adminParam(r, "id")
+	code, err := ps.DeleteEndpoint(id)
+	ps.finishChange(w, r, code, err, "endpoint", id)
+}
+
+func (ps *ProxyServer) AdminPersistConfig(w http.ResponseWriter, r *http.Request) {
+	if err := ps.PersistConfig(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"status":   "ok",
-		"upstream": upstreamId,
-		"action":   action,
+		"filename": ps.Cfg.ConfigFilename,
+	})
+}
+
+// AdminDrainUpstream closes the gate so new requests are held, and reports
+// how many requests are still in flight to the upstream.
+func (ps *ProxyServer) AdminDrainUpstream(w http.ResponseWriter, r *http.Request) {
+	id := adminParam(r, "id")
+
+	req := GateRequest{Action: ActionClose, Reason: "drain"}
+	if code, err := ps.controlGate(id, adminActor(r), req); err != nil {
+		writeJSONError(w, code, err.Error())
+		return
 	}
 
-	bs, _ := json.Marshal(ret)
-	w.Write(bs)
+	// deleted in the meantime
+	u := ps.lookupUpstream(id)
+	if u == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundUpstream.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"upstream":  id,
+		"gate":      gateName(u.Handler.GetGateState()),
+		"in_flight": u.Handler.GetInFlight(),
+	})
+}
+
+func (ps *ProxyServer) AdminReload(w http.ResponseWriter, r *http.Request) {
+	if code, err := ps.Reload(); err != nil {
+		writeJSONError(w, code, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "ok",
+		"filename": ps.Cfg.ConfigFilename,
+	})
+}
+
+// queueOf returns the queue of an endpoint for the admin API, answering
+// the error itself.
+func (ps *ProxyServer) queueOf(w http.ResponseWriter, r *http.Request) (*Endpoint, *EndpointQueue) {
+	e := ps.lookupEndpoint(adminParam(r, "id"))
+	if e == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundEndpoint.Error())
+		return nil, nil
+	}
+	if e.Handler.queue == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNoQueue.Error())
+		return nil, nil
+	}
+	return e, e.Handler.queue
+}
+
+// AdminGetQueue lists the requests waiting in the queue of an endpoint.
+func (ps *ProxyServer) AdminGetQueue(w http.ResponseWriter, r *http.Request) {
+	e, q := ps.queueOf(w, r)
+	if q == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"endpoint": e.Id,
+		"inflight": q.inflight.Inflight(),
+		"requests": q.Requests(),
+	})
+}
+
+// QueueAction flushes or releases waiting requests: `response` names the
+// response to answer them, `upstream` the upstream to release one to.
+type QueueAction struct {
+	Response string `json:"response"`
+	Upstream string `json:"upstream"`
+}
+
+// flushResponse checks the response to answer flushed requests with,
+// NameFlushed by default.
+func flushResponse(e *Endpoint, name string) (string, error) {
+	if name == "" {
+		return NameFlushed, nil
+	}
+	if _, ok := DefaultResponses[name]; ok {
+		return name, nil
+	}
+	for _, res := range e.Def.Response {
+		if res.Name == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("not found response: %s", name)
+}
+
+// AdminFlushQueue answers every waiting request of an endpoint with a
+// response instead of releasing it.
+func (ps *ProxyServer) AdminFlushQueue(w http.ResponseWriter, r *http.Request) {
+	var act QueueAction
+	if err := readJSON(r, &act); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	e, q := ps.queueOf(w, r)
+	if q == nil {
+		return
+	}
+	name, err := flushResponse(e, act.Response)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	n := q.Flush("", name)
+	log.Printf("[admin] queue of %s flushed by %s: %d requests, response=%s\n", e.Id, adminActor(r), n, name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flushed": n, "response": name})
+}
+
+// AdminCancelQueued answers one waiting request with a response, given as
+// ?response=, instead of releasing it.
+func (ps *ProxyServer) AdminCancelQueued(w http.ResponseWriter, r *http.Request) {
+	e, q := ps.queueOf(w, r)
+	if q == nil {
+		return
+	}
+	name, err := flushResponse(e, r.URL.Query().Get("response"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := adminParam(r, "request")
+	if q.Flush(id, name) == 0 {
+		writeJSONError(w, http.StatusNotFound, ErrNotQueued.Error())
+		return
+	}
+
+	log.Printf("[admin] request %s of %s canceled by %s, response=%s\n", id, e.Id, adminActor(r), name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "request": id, "response": name})
+}
+
+// AdminReleaseQueued sends one waiting request to an upstream of the
+// endpoint right away.
+func (ps *ProxyServer) AdminReleaseQueued(w http.ResponseWriter, r *http.Request) {
+	var act QueueAction
+	if err := readJSON(r, &act); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	e, q := ps.queueOf(w, r)
+	if q == nil {
+		return
+	}
+
+	upstream := act.Upstream
+	if upstream == "" {
+		upstream = e.Def.Upstream[0]
+	}
+	found := false
+	for _, id := range e.Def.upstreamIds() {
+		found = found || id == upstream
+	}
+	up := ps.lookupUpstream(upstream)
+	if !found || up == nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("not an upstream of endpoint %s: %s", e.Id, upstream))
+		return
+	}
+
+	id := adminParam(r, "request")
+	if err := q.ReleaseTo(id, up); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	log.Printf("[admin] request %s of %s released to %s by %s\n", id, e.Id, up.Id, adminActor(r))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "request": id, "upstream": up.Id})
+}
+
+// AdminEvents streams notifications as server-sent events.
+func (ps *ProxyServer) AdminEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	ch, cancel := ps.notifyManager.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ps.ctx.Done():
+			return
+		case m := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", strings.ReplaceAll(m, "\n", " "))
+			flusher.Flush()
+		}
+	}
+}
+
+func (ps *ProxyServer) AdminHandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(OpenAPIDocument))
+}
+
+func (ps *ProxyServer) AdminHandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+
+	ps.collectMetrics()
+	ps.metrics.WriteTo(w)
+}
+
+// collectMetrics refreshes the gauges that mirror the current state of
+// upstreams and endpoints right before they are scraped.
+func (ps *ProxyServer) collectMetrics() {
+	ps.Lock()
+	defer ps.Unlock()
+
+	ps.metrics.Reset(MetricGateState)
+	ps.metrics.Reset(MetricUpstreamStatus)
+	ps.metrics.Reset(MetricBreakerState)
+	ps.metrics.Reset(MetricQueueDepth)
+	ps.metrics.Reset(MetricQueueLaneDepth)
+	ps.metrics.Reset(MetricInflight)
+	ps.metrics.Reset(MetricRateLimitClients)
+
+	for _, u := range ps.upstreams {
+		gate := 0.0
+		if u.Handler.GetGateState() == GateOpened {
+			gate = 1
+		}
+		ps.metrics.Set(MetricGateState, gate, u.Id)
+		ps.metrics.Set(MetricUpstreamStatus, float64(u.Handler.GetUpstreamStatus()), u.Id)
+		if b := u.Handler.BreakerInfo(); b != nil {
+			ps.metrics.Set(MetricBreakerState, breakerValue(b.State), u.Id)
+		}
+	}
+
+	for _, e := range ps.endpoints {
+		if q := e.Handler.queue; q != nil {
+			ps.metrics.Set(MetricQueueDepth, float64(q.Len()), e.Id, e.Handler.UpstreamId())
+			ps.metrics.Set(MetricInflight, float64(q.inflight.Inflight()), e.Id)
+			for lane, n := range q.Depth() {
+				ps.metrics.Set(MetricQueueLaneDepth, float64(n), e.Id, lane)
+			}
+		}
+		if e.Def.RateLimit.enabled() {
+			ps.metrics.Set(MetricRateLimitClients, float64(e.Handler.limiter.Clients()), e.Id)
+		}
+	}
 }
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdmin builds a server from the example config without listening
+// and returns its admin router.
+func newTestAdmin(t *testing.T) (*ProxyServer, *AdminRouter) {
+	cfg, err := ReadConfigFile("../examples/buffy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := NewProxyServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ps.ctxCancel)
+
+	if err := ps.RunNotifier(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.CreateUpstreamHandlers(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.RegisterEndpoints(); err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := ps.newAdminRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ps, ar
+}
+
+func doAdmin(ar *AdminRouter, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ar.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminGateV1(t *testing.T) {
+	ps, ar := newTestAdmin(t)
+
+	w := doAdmin(ar, http.MethodPost, "/_admin/v1/upstreams/service1/gate", `{"action":"close"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("close: got %d %s", w.Code, w.Body)
+	}
+	if u := ps.lookupUpstream("service1"); u.Handler.GetGateState() != GateClosed {
+		t.Error("gate not closed")
+	}
+
+	// legacy alias
+	w = doAdmin(ar, http.MethodGet, "/_admin/gate?upstream=service1&action=open", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("legacy open: got %d %s", w.Code, w.Body)
+	}
+	if u := ps.lookupUpstream("service1"); u.Handler.GetGateState() != GateOpened {
+		t.Error("gate not opened")
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/_admin/v1/upstreams/service1/gate", "", http.StatusOK},
+		{http.MethodDelete, "/_admin/v1/upstreams/service1/gate", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/_admin/v1/upstreams/nope/gate", `{"action":"open"}`, http.StatusNotFound},
+		{http.MethodPut, "/_admin/v1/upstreams/service1/gate", `{"action":"toggle"}`, http.StatusBadRequest},
+		{http.MethodGet, "/_admin/v1/endpoints/example1", "", http.StatusOK},
+		{http.MethodGet, "/_admin/v1/nope", "", http.StatusNotFound},
+	} {
+		w := doAdmin(ar, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: content-type %q", tt.method, tt.path, ct)
+		}
+	}
+}
+
+func TestAdminOpenAPI(t *testing.T) {
+	if !json.Valid([]byte(OpenAPIDocument)) {
+		t.Error("invalid OpenAPI document")
+	}
+}
+
+func TestAdminRuntimeCRUD(t *testing.T) {
+	ps, ar := newTestAdmin(t)
+
+	for _, tt := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodPost, "/_admin/v1/upstreams", `{"id":"preview","endpoint":"http://localhost:9093"}`, http.StatusCreated},
+		{http.MethodPost, "/_admin/v1/upstreams", `{"id":"preview","endpoint":"http://localhost:9093"}`, http.StatusConflict},
+		{http.MethodPost, "/_admin/v1/upstreams", `{"id":"bad","endpoint":"localhost"}`, http.StatusBadRequest},
+		{http.MethodPost, "/_admin/v1/endpoints", `{"id":"preview","path":"/preview","type":"proxy","upstream":["preview"],"proxy_mode":"bypass","timeout":5}`, http.StatusCreated},
+		{http.MethodPost, "/_admin/v1/endpoints", `{"id":"dup","path":"/preview","type":"respond"}`, http.StatusBadRequest},
+		{http.MethodPost, "/_admin/v1/endpoints", `{"id":"orphan","path":"/orphan","type":"proxy","upstream":["nope"],"proxy_mode":"bypass"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/_admin/v1/upstreams/preview", "", http.StatusConflict},
+		{http.MethodPut, "/_admin/v1/upstreams/preview", `{"endpoint":"http://localhost:9094"}`, http.StatusOK},
+		{http.MethodPut, "/_admin/v1/endpoints/preview", `{"id":"other"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/_admin/v1/endpoints/preview", "", http.StatusOK},
+		{http.MethodDelete, "/_admin/v1/upstreams/preview", "", http.StatusOK},
+		{http.MethodDelete, "/_admin/v1/upstreams/preview", "", http.StatusNotFound},
+	} {
+		w := doAdmin(ar, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s %s: got %d, want %d: %s", tt.method, tt.path, tt.body, w.Code, tt.code, w.Body)
+		}
+	}
+
+	if len(ps.Cfg.Upstreams) != 2 || len(ps.Cfg.Endpoints) != 4 {
+		t.Errorf("config not restored: %d upstreams, %d endpoints", len(ps.Cfg.Upstreams), len(ps.Cfg.Endpoints))
+	}
+}
+
+func TestRuntimeUpdateHeld(t *testing.T) {
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}, EndpointDef{Timeout: Duration(10 * time.Second)})
+
+	var answers []chan *httptest.ResponseRecorder
+	hold := func(id string) {
+		q := ps.lookupEndpoint("held").Handler.queue
+		c := make(chan *httptest.ResponseRecorder, 1)
+		answers = append(answers, c)
+		r := httptest.NewRequest(http.MethodGet, "/held", nil)
+		r.Header.Set("X-Request-ID", id)
+		go func() {
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, r)
+			c <- w
+		}()
+		for n := q.Len(); q.Len() == n; {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	hold("a")
+	hold("b")
+
+	// the requests held move to the updated endpoint, in order
+	def := *ps.lookupEndpoint("held").Def
+	def.Desc = "updated"
+	if _, err := ps.UpdateEndpoint("held", def); err != nil {
+		t.Fatal(err)
+	}
+	reqs := ps.lookupEndpoint("held").Handler.queue.Requests()
+	if len(reqs) != 2 || reqs[0].Id != "a" || reqs[1].Id != "b" {
+		t.Fatalf("after the endpoint update: %+v", reqs)
+	}
+
+	// and to the endpoints of an updated upstream
+	hold("c")
+	if _, err := ps.UpdateUpstream("held", *up.Def); err != nil {
+		t.Fatal(err)
+	}
+	q := ps.lookupEndpoint("held").Handler.queue
+	if n := q.Len(); n != 3 {
+		t.Fatalf("after the upstream update: %d waiting", n)
+	}
+
+	next := ps.lookupUpstream("held")
+	next.Handler.UpdateUpstreamStatus(StatusAvailable)
+	next.Opengate("admin:test", "go", 0)
+	for i, id := range []string{"a", "b", "c"} {
+		if w := <-answers[i]; w.Code != http.StatusOK || w.Body.String() != id {
+			t.Errorf("request %s: got %d %q", id, w.Code, w.Body.String())
+		}
+	}
+	if n := q.inflight.Inflight(); n != 0 {
+		t.Errorf("in flight after the requests: %d", n)
+	}
+}
+
+func TestRuntimeReloadSwap(t *testing.T) {
+	ps, _ := newTestAdmin(t)
+
+	// valid as a whole, not one endpoint at a time
+	cfg := ps.Cfg.Clone()
+	a, b := &cfg.Endpoints[1], &cfg.Endpoints[2]
+	a.Path, b.Path = b.Path, a.Path
+	ps.Cfg.ConfigFilename = t.TempDir() + "/buffy.yaml"
+	if err := cfg.WriteConfigFile(ps.Cfg.ConfigFilename); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, err := ps.Reload(); err != nil {
+		t.Fatalf("reload: %d %s", code, err)
+	}
+	if e := ps.lookupEndpoint(a.Id); e == nil || e.Path != a.Path {
+		t.Errorf("%s: got %+v, want path %s", a.Id, e, a.Path)
+	}
+	if e := ps.lookupEndpoint(b.Id); e == nil || e.Path != b.Path {
+		t.Errorf("%s: got %+v, want path %s", b.Id, e, b.Path)
+	}
+}
+
+func TestRuntimeDeleteHeld(t *testing.T) {
+	ps, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {}, EndpointDef{Timeout: Duration(10 * time.Second)})
+	q := ps.lookupEndpoint("held").Handler.queue
+
+	answer := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/held", nil))
+		answer <- w
+	}()
+	for q.Len() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := ps.DeleteEndpoint("held"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case w := <-answer:
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "flushed") {
+			t.Errorf("got %d %q", w.Code, w.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request still held after its endpoint was deleted")
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleReadOnly = "read-only"
+	RoleOperator = "operator"
+	// RolePeer guards the cluster sync route. Peers authenticate with the
+	// cluster token; without one, operator credentials are required.
+	RolePeer = "peer"
+)
+
+type AdminAuth struct {
+	Tokens   []AdminToken `json:"tokens"    yaml:"tokens"`
+	Users    []AdminUser  `json:"users"     yaml:"users"`
+	AllowIPs []string     `json:"allow_ips" yaml:"allow_ips"`
+}
+
+type AdminToken struct {
+	Name  string `json:"name"  yaml:"name"`
+	Token string `json:"-"     yaml:"token"`
+	Role  string `json:"role"  yaml:"role"`
+}
+
+type AdminUser struct {
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"-"        yaml:"password"`
+	Role     string `json:"role"     yaml:"role"`
+}
+
+// Principal is the authenticated caller of an admin request.
+type Principal struct {
+	Name string
+	Role string
+}
+
+type CtxKeyPrincipal struct{}
+
+var ctxKeyPrincipal CtxKeyPrincipal
+
+// principalFromRequest returns the authenticated caller, or nil when the
+// admin API runs without authentication.
+func principalFromRequest(r *http.Request) *Principal {
+	p, _ := r.Context().Value(ctxKeyPrincipal).(*Principal)
+	return p
+}
+
+type adminGuard struct {
+	auth      *AdminAuth
+	allowNet  []*net.IPNet
+	peerToken string
+}
+
+func newAdminGuard(auth *AdminAuth) (*adminGuard, error) {
+	g := &adminGuard{auth: auth}
+
+	for _, t := range auth.Tokens {
+		if t.Token == "" {
+			return nil, errors.New("admin auth: empty token")
+		}
+		if !isValidRole(t.Role) {
+			return nil, errors.New("admin auth: invalid role: " + t.Role)
+		}
+	}
+
+	for _, u := range auth.Users {
+		if u.Username == "" {
+			return nil, errors.New("admin auth: empty username")
+		}
+		if !isValidRole(u.Role) {
+			return nil, errors.New("admin auth: invalid role: " + u.Role)
+		}
+	}
+
+	for _, s := range auth.AllowIPs {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("admin auth: invalid allow_ips: " + err.Error())
+		}
+		g.allowNet = append(g.allowNet, n)
+	}
+
+	return g, nil
+}
+
+func isValidRole(role string) bool {
+	return role == RoleReadOnly || role == RoleOperator
+}
+
+func (g *adminGuard) enabled() bool {
+	return len(g.auth.Tokens) > 0 || len(g.auth.Users) > 0
+}
+
+func (g *adminGuard) allowedIP(r *http.Request) bool {
+	if len(g.allowNet) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range g.allowNet {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticate resolves the caller from a bearer token or basic auth
+// credentials. It returns nil when no valid credentials were given.
+func (g *adminGuard) authenticate(r *http.Request) *Principal {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		for _, t := range g.auth.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return &Principal{Name: t.Name, Role: t.Role}
+			}
+		}
+		return nil
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, u := range g.auth.Users {
+			if u.Username == user && subtle.ConstantTimeCompare([]byte(u.Password), []byte(pass)) == 1 {
+				return &Principal{Name: u.Username, Role: u.Role}
+			}
+		}
+	}
+
+	return nil
+}
+
+// wrap protects an admin handler. Read-only callers may only use handlers
+// registered with RoleReadOnly; operators may use every handler.
+func (g *adminGuard) wrap(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.allowedIP(r) {
+			writeJSONError(w, http.StatusForbidden, "forbidden: address not allowed")
+			return
+		}
+
+		if role == RolePeer && g.peerToken != "" {
+			token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if subtle.ConstantTimeCompare([]byte(g.peerToken), []byte(token)) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			p := &Principal{Name: "peer", Role: RolePeer}
+			h(w, r.WithContext(context.WithValue(r.Context(), ctxKeyPrincipal, p)))
+			return
+		}
+
+		if !g.enabled() {
+			h(w, r)
+			return
+		}
+
+		p := g.authenticate(r)
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="buffy", Basic realm="buffy"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if role != RoleReadOnly && p.Role != RoleOperator {
+			writeJSONError(w, http.StatusForbidden, "forbidden: operator role required")
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), ctxKeyPrincipal, p)))
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminGuard(t *testing.T) {
+	g, err := newAdminGuard(&AdminAuth{
+		Tokens: []AdminToken{
+			{Name: "ci", Token: "op-token", Role: RoleOperator},
+			{Name: "dashboard", Token: "ro-token", Role: RoleReadOnly},
+		},
+		Users:    []AdminUser{{Username: "oncall", Password: "secret", Role: RoleOperator}},
+		AllowIPs: []string{"127.0.0.1", "10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	tests := []struct {
+		name   string
+		role   string
+		remote string
+		setup  func(r *http.Request)
+		code   int
+	}{
+		{"no credentials", RoleReadOnly, "127.0.0.1:1234", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bad token", RoleReadOnly, "127.0.0.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"read-only reads", RoleReadOnly, "127.0.0.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ro-token") }, http.StatusOK},
+		{"read-only operates", RoleOperator, "127.0.0.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer ro-token") }, http.StatusForbidden},
+		{"operator operates", RoleOperator, "10.1.2.3:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer op-token") }, http.StatusOK},
+		{"basic auth", RoleOperator, "127.0.0.1:1234", func(r *http.Request) { r.SetBasicAuth("oncall", "secret") }, http.StatusOK},
+		{"not allowed ip", RoleReadOnly, "192.168.0.1:1234", func(r *http.Request) { r.Header.Set("Authorization", "Bearer op-token") }, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/_admin/status", nil)
+		r.RemoteAddr = tt.remote
+		tt.setup(r)
+
+		w := httptest.NewRecorder()
+		g.wrap(tt.role, ok)(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+const (
+	DefaultBreakerWindow   = 10 * time.Second
+	DefaultBreakerCooldown = 10 * time.Second
+
+	// the window is counted in this many buckets
+	breakerBuckets = 10
+)
+
+// BreakerDef trips the circuit breaker of an upstream after `failures`
+// consecutive failed requests, or when `error_rate` of at least
+// `min_requests` requests failed within `window`. A failure is a transport
+// error or a 5xx response. The breaker closes the gate, and after
+// `cooldown` reopens it for at most `probes` requests at a time: as many
+// successes close the breaker, a failure trips it again.
+type BreakerDef struct {
+	Failures    int      `json:"failures"     yaml:"failures"`
+	ErrorRate   float64  `json:"error_rate"   yaml:"error_rate"`
+	MinRequests int      `json:"min_requests" yaml:"min_requests"`
+	Window      Duration `json:"window"       yaml:"window"`
+	Cooldown    Duration `json:"cooldown"     yaml:"cooldown"`
+	Probes      int      `json:"probes"       yaml:"probes"`
+}
+
+type breakerBucket struct {
+	start  time.Time
+	total  int
+	failed int
+}
+
+type breaker struct {
+	def      *BreakerDef
+	window   time.Duration
+	cooldown time.Duration
+	probes   int
+
+	state     string
+	since     time.Time
+	reason    string
+	failures  int
+	successes int
+	buckets   [breakerBuckets]breakerBucket
+	timer     *time.Timer
+
+	sync.Mutex
+}
+
+func (bd *BreakerDef) Validate() error {
+	if bd.Failures < 0 || bd.MinRequests < 0 || bd.Probes < 0 {
+		return fmt.Errorf("breaker: failures, min_requests and probes must not be negative")
+	}
+	if bd.ErrorRate < 0 || bd.ErrorRate > 1 {
+		return fmt.Errorf("breaker: error_rate must be between 0 and 1: %v", bd.ErrorRate)
+	}
+	if bd.Window < 0 || bd.Cooldown < 0 {
+		return fmt.Errorf("breaker: window and cooldown must not be negative")
+	}
+	// counted in buckets of a tenth of it
+	if bd.Window > 0 && time.Duration(bd.Window) < breakerBuckets {
+		return fmt.Errorf("breaker: window too short: %s", time.Duration(bd.Window))
+	}
+	return nil
+}
+
+func (bd *BreakerDef) enabled() bool {
+	return bd.Failures > 0 || bd.ErrorRate > 0
+}
+
+func newBreaker(bd *BreakerDef) *breaker {
+	b := &breaker{
+		def:      bd,
+		window:   time.Duration(bd.Window),
+		cooldown: time.Duration(bd.Cooldown),
+		probes:   bd.Probes,
+		state:    BreakerClosed,
+		since:    time.Now(),
+	}
+	if b.window == 0 {
+		b.window = DefaultBreakerWindow
+	}
+	if b.cooldown == 0 {
+		b.cooldown = DefaultBreakerCooldown
+	}
+	if b.probes == 0 {
+		b.probes = 1
+	}
+	return b
+}
+
+// record counts a request in the window and returns the requests and
+// failures within it.
+func (b *breaker) record(now time.Time, failed bool) (int, int) {
+	width := b.window / breakerBuckets
+	start := now.Truncate(width)
+
+	bk := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bk.start.Equal(start) {
+		*bk = breakerBucket{start: start}
+	}
+	bk.total++
+	if failed {
+		bk.failed++
+	}
+
+	total, fails := 0, 0
+	for _, bk := range b.buckets {
+		if now.Sub(bk.start) < b.window {
+			total += bk.total
+			fails += bk.failed
+		}
+	}
+	return total, fails
+}
+
+// set changes the state of the breaker, with its lock held.
+func (b *breaker) set(state, reason string) {
+	b.state = state
+	b.reason = reason
+	b.since = time.Now()
+	b.failures = 0
+	b.successes = 0
+	if state != BreakerClosed {
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// observe feeds the breaker with the outcome of a request sent upstream.
+func (us *UpstreamHandler) observe(failed bool) {
+	b := us.breaker
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerClosed:
+		total, fails := b.record(now, failed)
+		if failed {
+			b.failures++
+		} else {
+			b.failures = 0
+		}
+
+		reason := ""
+		if b.def.Failures > 0 && b.failures >= b.def.Failures {
+			reason = fmt.Sprintf("%d consecutive failures", b.failures)
+		} else if rate := float64(fails) / float64(total); b.def.ErrorRate > 0 && total >= b.def.MinRequests && rate >= b.def.ErrorRate {
+			reason = fmt.Sprintf("error rate %.2f of %d requests in %s", rate, total, b.window)
+		}
+		if reason == "" {
+			b.Unlock()
+			return
+		}
+		b.Unlock()
+		us.tripBreaker(reason)
+
+	case BreakerHalfOpen:
+		if failed {
+			b.Unlock()
+			us.tripBreaker("probe failed")
+			return
+		}
+
+		b.successes++
+		if b.successes < b.probes {
+			b.Unlock()
+			return
+		}
+		reason := fmt.Sprintf("%d probes succeeded", b.successes)
+		b.set(BreakerClosed, reason)
+		b.Unlock()
+
+		log.Printf("[upstream:%s] breaker closed: %s\n", us.def.Id, reason)
+		us.notifyBreaker(BreakerClosed, reason)
+		// more requests may be released
+		us.broadcast()
+
+	default:
+		b.Unlock()
+	}
+}
+
+// tripBreaker opens the breaker and closes the gate until the cooldown
+// elapses. A gate already closed by someone else is left to them.
+func (us *UpstreamHandler) tripBreaker(reason string) {
+	b := us.breaker
+
+	us.Lock()
+	defer us.Unlock()
+
+	if us.GetGateState() != GateOpened {
+		return
+	}
+
+	b.Lock()
+	if b.state == BreakerOpen {
+		b.Unlock()
+		return
+	}
+	b.set(BreakerOpen, reason)
+	b.timer = time.AfterFunc(b.cooldown, us.probeBreaker)
+	b.Unlock()
+
+	log.Printf("[upstream:%s] breaker open: %s\n", us.def.Id, reason)
+	us.notifyBreaker(BreakerOpen, reason)
+	us.setGate(GateClosed, ActorBreaker, "breaker open: "+reason, 0)
+}
+
+// probeBreaker reopens the gate for probes once the cooldown elapsed. A
+// gate changed by anyone else in the meantime resets the breaker instead.
+func (us *UpstreamHandler) probeBreaker() {
+	b := us.breaker
+
+	us.Lock()
+	defer us.Unlock()
+
+	b.Lock()
+	if b.state != BreakerOpen {
+		b.Unlock()
+		return
+	}
+	if us.gate == nil || us.gate.Actor != ActorBreaker {
+		b.set(BreakerClosed, "gate changed by "+us.gateActor())
+		b.Unlock()
+		return
+	}
+	b.set(BreakerHalfOpen, "cooldown elapsed")
+	b.Unlock()
+
+	log.Printf("[upstream:%s] breaker half open\n", us.def.Id)
+	us.notifyBreaker(BreakerHalfOpen, "cooldown elapsed")
+	us.setGate(GateOpened, ActorBreaker, "breaker half open: probing", 0)
+}
+
+// restoreBreaker brings the breaker in line with a gate restored from the
+// state or merged from a peer, with the upstream's lock held. A gate the
+// breaker closed opens it again, to probe once the rest of the cooldown
+// elapses; without a breaker any more, the gate is reopened.
+func (us *UpstreamHandler) restoreBreaker() {
+	change := us.gate
+	if change == nil || change.Actor != ActorBreaker {
+		us.resetBreaker(us.gateActor())
+		return
+	}
+	if change.State != gateName(GateClosed) {
+		// probing or closed already
+		us.resetBreaker(ActorBreaker)
+		return
+	}
+
+	b := us.breaker
+	if b == nil {
+		us.setGate(GateOpened, ActorSystem, "no breaker: "+change.Reason, 0)
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.set(BreakerOpen, strings.TrimPrefix(change.Reason, "breaker open: "))
+	b.since = change.ChangedAt
+	b.timer = time.AfterFunc(time.Until(change.ChangedAt.Add(b.cooldown)), us.probeBreaker)
+	log.Printf("[upstream:%s] breaker open: restored\n", us.def.Id)
+}
+
+// stopBreaker stops the probe timer of an upstream replaced at runtime.
+func (us *UpstreamHandler) stopBreaker() {
+	b := us.breaker
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+// resetBreaker hands the gate back to whoever changed it, with the
+// upstream's lock held.
+func (us *UpstreamHandler) resetBreaker(actor string) {
+	b := us.breaker
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state != BreakerClosed {
+		b.set(BreakerClosed, "gate changed by "+actor)
+		log.Printf("[upstream:%s] breaker closed: %s\n", us.def.Id, b.reason)
+	}
+}
+
+// probing reports whether the breaker lets no more requests in, as all
+// the probes are in flight.
+func (us *UpstreamHandler) probing() bool {
+	b := us.breaker
+	if b == nil {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state == BreakerHalfOpen && int(us.GetInFlight()) >= b.probes
+}
+
+// gateActor returns who changed the gate last, with the lock held.
+func (us *UpstreamHandler) gateActor() string {
+	if us.gate == nil {
+		return ActorSystem
+	}
+	return us.gate.Actor
+}
+
+func breakerValue(state string) float64 {
+	switch state {
+	case BreakerOpen:
+		return 1
+	case BreakerHalfOpen:
+		return 2
+	}
+	return 0
+}
+
+func (us *UpstreamHandler) notifyBreaker(state, reason string) {
+	bs, _ := json.Marshal(map[string]string{
+		"status":   "breaker",
+		"upstream": us.def.Id,
+		"state":    state,
+		"reason":   reason,
+	})
+	us.notify(string(bs))
+}
+
+// BreakerInfo reports the state of a circuit breaker.
+type BreakerInfo struct {
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+	Failures int       `json:"failures"`
+}
+
+func (us *UpstreamHandler) BreakerInfo() *BreakerInfo {
+	b := us.breaker
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return &BreakerInfo{
+		State:    b.state,
+		Reason:   b.reason,
+		Since:    b.since,
+		Failures: b.failures,
+	}
+}
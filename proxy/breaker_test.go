@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	us := &UpstreamHandler{
+		def:            &UpstreamDef{Id: "service1"},
+		notiC:          make(chan string, 10),
+		GateState:      GateOpened,
+		UpstreamStatus: StatusAvailable,
+	}
+	us.breaker = newBreaker(&BreakerDef{Failures: 3, Cooldown: Duration(50 * time.Millisecond), Probes: 2})
+
+	us.observe(true)
+	us.observe(true)
+	us.observe(false)
+	us.observe(true)
+	us.observe(true)
+	if us.GetGateState() != GateOpened {
+		t.Fatal("tripped before 3 consecutive failures")
+	}
+
+	us.observe(true)
+	if b := us.BreakerInfo(); b.State != BreakerOpen || us.GetGateState() != GateClosed || us.GateInfo().Actor != ActorBreaker {
+		t.Fatalf("not tripped: %+v", b)
+	}
+
+	// half open: the gate reopens for 2 probes at a time
+	time.Sleep(100 * time.Millisecond)
+	if b := us.BreakerInfo(); b.State != BreakerHalfOpen || us.GetGateState() != GateOpened {
+		t.Fatalf("not half open: %+v", b)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := us.admit(time.Now()); !ok {
+			t.Fatalf("probe %d not admitted", i)
+		}
+	}
+	if ok, _ := us.admit(time.Now()); ok {
+		t.Fatal("admitted more than the probes")
+	}
+
+	// a failed probe trips it again
+	us.done()
+	us.observe(true)
+	if b := us.BreakerInfo(); b.State != BreakerOpen || us.GetGateState() != GateClosed {
+		t.Fatalf("failed probe: %+v", b)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	us.observe(false)
+	us.observe(false)
+	if b := us.BreakerInfo(); b.State != BreakerClosed || us.GetGateState() != GateOpened {
+		t.Fatalf("probes succeeded: %+v", b)
+	}
+
+	// an operator taking over the gate resets the breaker
+	for i := 0; i < 3; i++ {
+		us.observe(true)
+	}
+	us.SetGate(GateClosed, "admin:oncall", "investigating", 0)
+	time.Sleep(100 * time.Millisecond)
+	if b := us.BreakerInfo(); b.State != BreakerClosed || us.GetGateState() != GateClosed {
+		t.Errorf("breaker kept the gate: %+v", b)
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b := newBreaker(&BreakerDef{ErrorRate: 0.5, MinRequests: 4, Window: Duration(time.Second)})
+
+	// aligned on the buckets
+	now := time.Unix(1000, 0)
+	if total, fails := b.record(now, true); total != 1 || fails != 1 {
+		t.Errorf("got %d/%d", fails, total)
+	}
+	b.record(now.Add(100*time.Millisecond), false)
+	if total, fails := b.record(now.Add(200*time.Millisecond), true); total != 3 || fails != 2 {
+		t.Errorf("got %d/%d", fails, total)
+	}
+
+	// the first ones left the window
+	if total, fails := b.record(now.Add(1150*time.Millisecond), false); total != 2 || fails != 1 {
+		t.Errorf("after the window: got %d/%d", fails, total)
+	}
+}
+
+func TestBreakerRestore(t *testing.T) {
+	us := &UpstreamHandler{
+		def:            &UpstreamDef{Id: "service1"},
+		notiC:          make(chan string, 10),
+		GateState:      GateOpened,
+		UpstreamStatus: StatusAvailable,
+	}
+	us.breaker = newBreaker(&BreakerDef{Failures: 3, Cooldown: Duration(50 * time.Millisecond)})
+
+	// closed by the breaker before a restart, or on a peer
+	rec := GateRecord{
+		GateChange: GateChange{State: "closed", Actor: ActorBreaker, Reason: "breaker open: 3 consecutive failures", ChangedAt: time.Now()},
+		Previous:   "opened",
+	}
+	us.restoreGate(rec)
+	if b := us.BreakerInfo(); b.State != BreakerOpen || us.GetGateState() != GateClosed {
+		t.Fatalf("not restored: %+v", b)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if b := us.BreakerInfo(); b.State != BreakerHalfOpen || us.GetGateState() != GateOpened {
+		t.Fatalf("no probe after the cooldown: %+v", b)
+	}
+
+	rec.ChangedAt = time.Now()
+	rec.Version = rec.ChangedAt.UnixNano()
+	us.mergeGate(rec)
+	if b := us.BreakerInfo(); b.State != BreakerOpen || us.GetGateState() != GateClosed {
+		t.Fatalf("not merged: %+v", b)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if b := us.BreakerInfo(); b.State != BreakerHalfOpen || us.GetGateState() != GateOpened {
+		t.Fatalf("no probe after the cooldown: %+v", b)
+	}
+
+	// without a breaker any more, the gate reopens
+	us.breaker = nil
+	rec.ChangedAt = time.Now()
+	us.restoreGate(rec)
+	if us.GetGateState() != GateOpened {
+		t.Error("gate kept closed without a breaker")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	if err := (&BreakerDef{Failures: 1, Window: Duration(5)}).Validate(); err == nil {
+		t.Error("accepted a window shorter than its buckets")
+	}
+}
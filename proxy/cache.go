@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMaxBody = 1 << 20
+
+	CacheHit         = "hit"
+	CacheStale       = "stale"
+	CacheRevalidated = "revalidated"
+	CacheMiss        = "miss"
+)
+
+// CacheDef keeps up to `max_entries` GET responses of an endpoint in
+// memory, and in `dir` when set so that they survive a restart. Responses
+// are cached as allowed by their Cache-Control, Expires and Vary headers,
+// for `default_ttl` without explicit freshness, and revalidated with their
+// ETag or Last-Modified once stale. The request headers listed in `vary`
+// are part of the key. With `serve_stale_when_gated`, a cached response is
+// served, even stale, while no upstream of the endpoint can take requests.
+type CacheDef struct {
+	MaxEntries          int      `json:"max_entries"            yaml:"max_entries"`
+	MaxBody             int64    `json:"max_body"               yaml:"max_body"`
+	DefaultTTL          Duration `json:"default_ttl"            yaml:"default_ttl"`
+	Vary                []string `json:"vary"                   yaml:"vary"`
+	Dir                 string   `json:"dir"                    yaml:"dir"`
+	ServeStaleWhenGated bool     `json:"serve_stale_when_gated" yaml:"serve_stale_when_gated"`
+}
+
+func (cd *CacheDef) Validate() error {
+	if cd.MaxEntries < 0 || cd.MaxBody < 0 || cd.DefaultTTL < 0 {
+		return fmt.Errorf("cache: max_entries, max_body and default_ttl must not be negative")
+	}
+	if !cd.enabled() && (cd.Dir != "" || cd.ServeStaleWhenGated) {
+		return fmt.Errorf("cache: requires max_entries")
+	}
+	return nil
+}
+
+func (cd *CacheDef) enabled() bool {
+	return cd.MaxEntries > 0
+}
+
+// cacheEntry is a stored response, also its format on disk.
+type cacheEntry struct {
+	Key       string      `json:"key"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	StoredAt  time.Time   `json:"stored_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+type responseCache struct {
+	def     *CacheDef
+	dir     string
+	maxBody int64
+
+	entries map[string]*list.Element
+	lru     *list.List
+
+	sync.Mutex
+}
+
+func newResponseCache(cd *CacheDef, basepath string) *responseCache {
+	c := &responseCache{
+		def:     cd,
+		dir:     cd.Dir,
+		maxBody: cd.MaxBody,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if c.maxBody == 0 {
+		c.maxBody = DefaultCacheMaxBody
+	}
+	if c.dir != "" && !filepath.IsAbs(c.dir) {
+		c.dir = filepath.Join(basepath, c.dir)
+	}
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0755); err != nil {
+			log.Printf("[cache] %s: %s\n", c.dir, err)
+			c.dir = ""
+		}
+	}
+	return c
+}
+
+// key identifies a request: the URL requested from the endpoint and the
+// `vary` headers. A HEAD shares the entry of the GET.
+func (c *responseCache) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(requestURI(r))
+	for _, h := range c.def.Vary {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// requestURI returns the URI the client requested from the endpoint. The
+// reverse proxy rewrites the URL of a request but keeps its RequestURI.
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+func (c *responseCache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// get returns the entry of a request, from memory or from disk.
+func (c *responseCache) get(r *http.Request) *cacheEntry {
+	if c == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	key := c.key(r)
+
+	c.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	c.Unlock()
+
+	if c.dir == "" {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(c.filename(key))
+	if err != nil {
+		return nil
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(bs, e); err != nil || e.Key != key {
+		return nil
+	}
+	c.put(e, false)
+	return e
+}
+
+// put stores an entry, evicting the least recently used ones from memory.
+func (c *responseCache) put(e *cacheEntry, save bool) {
+	c.Lock()
+	if el, ok := c.entries[e.Key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[e.Key] = c.lru.PushFront(e)
+	}
+	for c.lru.Len() > c.def.MaxEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).Key)
+	}
+	c.Unlock()
+
+	if save && c.dir != "" {
+		bs, _ := json.Marshal(e)
+		if err := ioutil.WriteFile(c.filename(e.Key), bs, 0644); err != nil {
+			log.Printf("[cache] %s\n", err)
+		}
+	}
+}
+
+// Purge removes the entries whose URL starts with prefix, all of them
+// when empty, and returns how many were removed from memory.
+func (c *responseCache) Purge(prefix string) int {
+	c.Lock()
+	n := 0
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	c.Unlock()
+
+	if c.dir != "" {
+		files, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+		for _, f := range files {
+			e := &cacheEntry{}
+			if bs, err := ioutil.ReadFile(f); err == nil && json.Unmarshal(bs, e) == nil && strings.HasPrefix(e.Key, prefix) {
+				os.Remove(f)
+			}
+		}
+	}
+
+	return n
+}
+
+// CacheEntryInfo describes an entry for the admin API.
+type CacheEntryInfo struct {
+	Key       string    `json:"key"`
+	Status    int       `json:"status"`
+	Size      int       `json:"size"`
+	ETag      string    `json:"etag,omitempty"`
+	StoredAt  time.Time `json:"stored_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Fresh     bool      `json:"fresh"`
+}
+
+// Entries lists the entries in memory, most recently used first.
+func (c *responseCache) Entries() []CacheEntryInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	infos := []CacheEntryInfo{}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		infos = append(infos, CacheEntryInfo{
+			Key:       e.Key,
+			Status:    e.Status,
+			Size:      len(e.Body),
+			ETag:      e.Header.Get("ETag"),
+			StoredAt:  e.StoredAt,
+			ExpiresAt: e.ExpiresAt,
+			Fresh:     e.fresh(now),
+		})
+	}
+	return infos
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.ExpiresAt)
+}
+
+func (e *cacheEntry) validated() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// response answers a request from the entry; a matching If-None-Match is
+// answered with 304.
+func (e *cacheEntry) response(r *http.Request, state string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt).Seconds())))
+	h.Set("X-Buffy-Cache", state)
+	if state == CacheStale {
+		h.Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	code, body := e.Status, e.Body
+	if etag := h.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		code, body = http.StatusNotModified, nil
+	}
+	if r.Method == http.MethodHead {
+		body = nil
+	}
+
+	return &http.Response{
+		Request:       r,
+		Header:        h,
+		StatusCode:    code,
+		Status:        http.StatusText(code),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// cacheControl parses a Cache-Control header into its directives.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, value = d[:i], strings.Trim(d[i+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+// noCache reports whether a request asks not to be answered from the cache
+// without revalidation.
+func noCache(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	return cc["max-age"] == "0" || r.Header.Get("Pragma") == "no-cache"
+}
+
+// lifetime returns how long a response stays fresh, and false if it must
+// not be stored.
+func (c *responseCache) lifetime(r *http.Request, res *http.Response, now time.Time) (time.Duration, bool) {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return 0, false
+	}
+	if _, ok := cacheControl(r.Header)["no-store"]; ok {
+		return 0, false
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, false
+	}
+
+	if res.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	// the key only holds the `vary` headers
+	for _, v := range res.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !containsFold(c.def.Vary, h) {
+				return 0, false
+			}
+		}
+	}
+
+	cc := cacheControl(res.Header)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+
+	ttl := time.Duration(c.def.DefaultTTL)
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if v := res.Header.Get("Expires"); v != "" {
+		ttl = 0
+		if t, err := http.ParseTime(v); err == nil {
+			ttl = t.Sub(now)
+		}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		ttl = 0
+	}
+
+	if ttl <= 0 {
+		ttl = 0
+		// kept only to be revalidated, or served when gated
+		if res.Header.Get("ETag") == "" && res.Header.Get("Last-Modified") == "" && !c.def.ServeStaleWhenGated {
+			return 0, false
+		}
+	}
+	return ttl, true
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// store wraps the body of a response so that it is cached once read in
+// full, unless it is larger than max_body.
+func (c *responseCache) store(key string, r *http.Request, res *http.Response) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	ttl, ok := c.lifetime(r, res, now)
+	if !ok {
+		return
+	}
+
+	res.Body = &cacheBody{
+		ReadCloser: res.Body,
+		cache:      c,
+		entry: &cacheEntry{
+			Key:       key,
+			Status:    res.StatusCode,
+			Header:    res.Header.Clone(),
+			StoredAt:  now,
+			ExpiresAt: now.Add(ttl),
+		},
+	}
+}
+
+// refresh extends a stale entry revalidated by a 304 response.
+func (c *responseCache) refresh(e *cacheEntry, r *http.Request, res *http.Response) *cacheEntry {
+	now := time.Now()
+
+	merged := &cacheEntry{Key: e.Key, Status: e.Status, Header: e.Header.Clone(), Body: e.Body, StoredAt: now}
+	for _, h := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date"} {
+		if v := res.Header.Get(h); v != "" {
+			merged.Header.Set(h, v)
+		}
+	}
+
+	res304 := &http.Response{StatusCode: e.Status, Header: merged.Header}
+	ttl, ok := c.lifetime(r, res304, now)
+	if !ok {
+		return e
+	}
+	merged.ExpiresAt = now.Add(ttl)
+	c.put(merged, true)
+	return merged
+}
+
+type cacheBody struct {
+	io.ReadCloser
+	cache *responseCache
+	entry *cacheEntry
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.cache.maxBody {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.over && b.entry != nil {
+		b.entry.Body = b.buf.Bytes()
+		b.cache.put(b.entry, true)
+		b.entry = nil
+	}
+	return n, err
+}
+
+// AdminGetCache lists the cached responses of an endpoint.
+func (ps *ProxyServer) AdminGetCache(w http.ResponseWriter, r *http.Request) {
+	e := ps.lookupEndpoint(adminParam(r, "id"))
+	if e == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundEndpoint.Error())
+		return
+	}
+	if e.Handler.cache == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNoCache.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"max_entries": e.Def.Cache.MaxEntries,
+		"entries":     e.Handler.cache.Entries(),
+	})
+}
+
+// AdminPurgeCache removes the cached responses of an endpoint, those
+// whose URL starts with ?prefix= when given.
+func (ps *ProxyServer) AdminPurgeCache(w http.ResponseWriter, r *http.Request) {
+	e := ps.lookupEndpoint(adminParam(r, "id"))
+	if e == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundEndpoint.Error())
+		return
+	}
+	if e.Handler.cache == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNoCache.Error())
+		return
+	}
+
+	n := e.Handler.cache.Purge(r.URL.Query().Get("prefix"))
+	log.Printf("[admin] cache of %s purged: %d entries\n", e.Id, n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": n})
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	c := newResponseCache(&CacheDef{MaxEntries: 10, Vary: []string{"Accept"}}, ".")
+	now := time.Now()
+
+	for _, tt := range []struct {
+		header http.Header
+		code   int
+		ttl    time.Duration
+		ok     bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=60"}}, 200, time.Minute, true},
+		{http.Header{"Cache-Control": {"public, s-maxage=10, max-age=60"}}, 200, 10 * time.Second, true},
+		{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, 200, time.Hour, true},
+		{http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, 200, 0, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, 200, 0, false},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 200, 0, false},
+		{http.Header{"Cache-Control": {"no-store"}}, 200, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept"}}, 200, time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Cookie"}}, 200, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, 200, 0, false},
+		{http.Header{"Cache-Control": {"max-age=60"}}, 500, 0, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		ttl, ok := c.lifetime(r, &http.Response{StatusCode: tt.code, Header: tt.header}, now)
+		if ok != tt.ok || ok && (ttl < tt.ttl-time.Second || ttl > tt.ttl) {
+			t.Errorf("%d %v: got %s %v", tt.code, tt.header, ttl, ok)
+		}
+	}
+}
+
+func TestCacheEndpoint(t *testing.T) {
+	var calls int32
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/held/fresh" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("v1 " + r.URL.Path))
+	}, EndpointDef{
+		Timeout:  Duration(200 * time.Millisecond),
+		MaxQueue: 10,
+		Cache:    CacheDef{MaxEntries: 10, ServeStaleWhenGated: true},
+	})
+	up.Opengate("admin:test", "", 0)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for i, want := range []string{"", CacheHit} {
+		w := get("/held/fresh")
+		if w.Body.String() != "v1 /held/fresh" || w.Header().Get("X-Buffy-Cache") != want {
+			t.Errorf("fresh #%d: got %q %q", i, w.Body.String(), w.Header().Get("X-Buffy-Cache"))
+		}
+	}
+
+	// stored, then revalidated with its ETag
+	for i, want := range []string{"", CacheRevalidated} {
+		w := get("/held/stale")
+		if w.Code != 200 || w.Body.String() != "v1 /held/stale" || w.Header().Get("X-Buffy-Cache") != want {
+			t.Errorf("stale #%d: got %d %q %q", i, w.Code, w.Body.String(), w.Header().Get("X-Buffy-Cache"))
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("upstream calls: got %d", n)
+	}
+
+	// a client cannot store a response under another URL
+	r := httptest.NewRequest(http.MethodGet, "/held/evil", nil)
+	r.Header.Set("X-Buffy-URL", "/held/home")
+	ps.ServeProxy(httptest.NewRecorder(), r)
+	if w := get("/held/home"); w.Body.String() != "v1 /held/home" || w.Header().Get("X-Buffy-Cache") != "" {
+		t.Errorf("poisoned: got %q %q", w.Body.String(), w.Header().Get("X-Buffy-Cache"))
+	}
+	atomic.StoreInt32(&calls, 3)
+
+	// served stale at once while the gate is closed
+	up.Closegate("admin:test", "deploy", 0)
+	st := time.Now()
+	if w := get("/held/stale"); w.Header().Get("X-Buffy-Cache") != CacheStale || time.Since(st) > 100*time.Millisecond {
+		t.Errorf("gated: got %q", w.Header().Get("X-Buffy-Cache"))
+	}
+
+	ar, err := ps.newAdminRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := doAdmin(ar, http.MethodGet, "/_admin/v1/endpoints/held/cache", "")
+	var listed struct {
+		Entries []CacheEntryInfo `json:"entries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed.Entries) != 4 {
+		t.Errorf("list: got %d %s", w.Code, w.Body)
+	}
+
+	w = doAdmin(ar, http.MethodDelete, "/_admin/v1/endpoints/held/cache?prefix=/held/fresh", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"purged":1}` {
+		t.Errorf("purge: got %d %s", w.Code, w.Body)
+	}
+	if w := get("/held/fresh"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("purged entry served: %d", w.Code)
+	}
+}
+
+func TestCacheDisk(t *testing.T) {
+	def := &CacheDef{MaxEntries: 1, Dir: t.TempDir()}
+	r := httptest.NewRequest(http.MethodGet, "/api?a=1", nil)
+
+	c := newResponseCache(def, ".")
+	c.put(&cacheEntry{Key: c.key(r), Status: 200, Header: http.Header{}, Body: []byte("saved")}, true)
+
+	// after a restart
+	c = newResponseCache(def, ".")
+	if e := c.get(r); e == nil || string(e.Body) != "saved" {
+		t.Fatalf("not loaded from disk: %+v", e)
+	}
+
+	c.Purge("/api")
+	if e := newResponseCache(def, ".").get(r); e != nil {
+		t.Error("purged entry still on disk")
+	}
+}
@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClusterSyncInterval = 5 * time.Second
+	ClusterSyncTimeout         = 3 * time.Second
+	ClusterPushDebounce        = 50 * time.Millisecond
+)
+
+// ClusterDef makes replicas share their gates and runtime config. Every
+// replica lists the admin base URL of the others, e.g.
+// "http://10.0.0.2:7001/_admin".
+type ClusterDef struct {
+	NodeId       string   `json:"node_id"       yaml:"node_id"`
+	Peers        []string `json:"peers"         yaml:"peers"`
+	Token        string   `json:"-"             yaml:"token"`
+	SyncInterval Duration `json:"sync_interval" yaml:"sync_interval"`
+}
+
+// ClusterState is exchanged between peers. Gates and config carry a
+// version and the node that made the change; the newest one wins.
+type ClusterState struct {
+	Node   string                `json:"node"`
+	Gates  map[string]GateRecord `json:"gates"`
+	Config *ClusterConfig        `json:"config,omitempty"`
+}
+
+type ClusterConfig struct {
+	Version   int64         `json:"version"`
+	Node      string        `json:"node"`
+	Upstreams []UpstreamDef `json:"upstreams"`
+	Endpoints []EndpointDef `json:"endpoints"`
+}
+
+type ClusterPeer struct {
+	URL       string    `json:"url"`
+	Node      string    `json:"node,omitempty"`
+	LastSync  time.Time `json:"last_sync,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Cluster pushes the local state to every peer whenever it changes and
+// every sync interval, and merges what the peers answer. A cluster without
+// peers does nothing.
+type Cluster struct {
+	ps       *ProxyServer
+	def      *ClusterDef
+	nodeId   string
+	interval time.Duration
+	peers    []*ClusterPeer
+	client   *http.Client
+	touchC   chan struct{}
+
+	// serializes merges, which replay config changes
+	mergeLock sync.Mutex
+
+	sync.Mutex
+}
+
+type CtxKeyCluster struct{}
+
+var ctxKeyCluster CtxKeyCluster
+
+func clusterFromContext(ctx context.Context) *Cluster {
+	c, _ := ctx.Value(ctxKeyCluster).(*Cluster)
+	return c
+}
+
+func (cd *ClusterDef) Validate() error {
+	if cd.SyncInterval < 0 {
+		return fmt.Errorf("cluster: invalid sync_interval: %s", time.Duration(cd.SyncInterval))
+	}
+
+	for _, p := range cd.Peers {
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			return fmt.Errorf("cluster: invalid peer: %q", p)
+		}
+	}
+
+	return nil
+}
+
+func NewCluster(cfg *BuffyConfig) (*Cluster, error) {
+	def := &cfg.Server.Cluster
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		def:      def,
+		nodeId:   def.NodeId,
+		interval: DefaultClusterSyncInterval,
+		client:   &http.Client{Timeout: ClusterSyncTimeout},
+		touchC:   make(chan struct{}, 1),
+	}
+
+	if def.SyncInterval > 0 {
+		c.interval = time.Duration(def.SyncInterval)
+	}
+
+	if c.nodeId == "" {
+		host, _ := os.Hostname()
+		c.nodeId = fmt.Sprintf("%s:%d", host, cfg.Server.Admin.Port)
+	}
+
+	for _, p := range def.Peers {
+		c.peers = append(c.peers, &ClusterPeer{URL: strings.TrimSuffix(p, "/")})
+	}
+
+	return c, nil
+}
+
+func (c *Cluster) NodeId() string {
+	if c == nil {
+		return ""
+	}
+	return c.nodeId
+}
+
+func (c *Cluster) enabled() bool {
+	return c != nil && len(c.peers) > 0
+}
+
+// Touch schedules a push to the peers.
+func (c *Cluster) Touch() {
+	if !c.enabled() {
+		return
+	}
+
+	select {
+	case c.touchC <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs with the peers after every touch and every sync interval.
+func (c *Cluster) Run(ctx context.Context) {
+	if !c.enabled() {
+		return
+	}
+
+	log.Printf("[cluster] node %s, %d peers, sync every %s\n", c.nodeId, len(c.peers), c.interval)
+
+	go func() {
+		tick := time.NewTicker(c.interval)
+		defer tick.Stop()
+
+		c.SyncAll()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.touchC:
+				time.Sleep(ClusterPushDebounce)
+				c.SyncAll()
+			case <-tick.C:
+				c.SyncAll()
+			}
+		}
+	}()
+}
+
+// SyncAll pushes the local state to every peer and merges their answers.
+func (c *Cluster) SyncAll() {
+	var wg sync.WaitGroup
+	for _, p := range c.peers {
+		wg.Add(1)
+		go func(p *ClusterPeer) {
+			defer wg.Done()
+			c.sync(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) sync(p *ClusterPeer) {
+	remote, err := c.push(p.URL, c.ps.clusterState())
+
+	c.Lock()
+	if err != nil {
+		if p.LastError == "" {
+			log.Printf("[cluster] sync %s: err=%s\n", p.URL, err)
+		}
+		p.LastError = err.Error()
+	} else {
+		p.Node = remote.Node
+		p.LastSync = time.Now()
+		p.LastError = ""
+	}
+	c.Unlock()
+
+	if err == nil {
+		c.Merge(remote)
+	}
+}
+
+func (c *Cluster) push(peer string, st *ClusterState) (*ClusterState, error) {
+	bs, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, peer+"/v1/cluster/sync", bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.def.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.def.Token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer answered %d", res.StatusCode)
+	}
+
+	var remote ClusterState
+	if err := json.NewDecoder(res.Body).Decode(&remote); err != nil {
+		return nil, err
+	}
+
+	return &remote, nil
+}
+
+// Merge applies the gates and config of a peer that are newer than ours.
+func (c *Cluster) Merge(remote *ClusterState) {
+	if remote.Node == c.nodeId {
+		return
+	}
+
+	c.mergeLock.Lock()
+	defer c.mergeLock.Unlock()
+
+	// config first so that gates of new upstreams apply
+	if remote.Config != nil {
+		if err := c.ps.mergeConfig(remote.Config); err != nil {
+			log.Printf("[cluster] config from %s: err=%s\n", remote.Node, err)
+		}
+	}
+
+	for id, rec := range remote.Gates {
+		if u := c.ps.lookupUpstream(id); u != nil {
+			u.Handler.mergeGate(rec)
+		}
+	}
+}
+
+// Peers returns a copy of the peers' sync status.
+func (c *Cluster) Peers() []ClusterPeer {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	peers := []ClusterPeer{}
+	for _, p := range c.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// newer reports whether a change made at version va by node na supersedes
+// one made at vb by nb. Ties are broken by node id so that every replica
+// picks the same winner.
+func newer(va int64, na string, vb int64, nb string) bool {
+	if va != vb {
+		return va > vb
+	}
+	return na > nb
+}
+
+// clusterState captures the gates and, once changed at runtime, the
+// upstreams and endpoints.
+func (ps *ProxyServer) clusterState() *ClusterState {
+	ps.Lock()
+	defer ps.Unlock()
+
+	st := &ClusterState{
+		Node:  ps.cluster.NodeId(),
+		Gates: make(map[string]GateRecord),
+	}
+	for _, u := range ps.upstreams {
+		st.Gates[u.Id] = u.Handler.gateRecord()
+	}
+
+	if ps.configVersion > 0 {
+		st.Config = &ClusterConfig{
+			Version:   ps.configVersion,
+			Node:      ps.configNode,
+			Upstreams: ps.Cfg.Upstreams,
+			Endpoints: ps.Cfg.Endpoints,
+		}
+	}
+
+	return st
+}
+
+// mergeConfig replays the upstreams and endpoints of a newer remote config.
+func (ps *ProxyServer) mergeConfig(rc *ClusterConfig) error {
+	ps.Lock()
+	if !newer(rc.Version, rc.Node, ps.configVersion, ps.configNode) {
+		ps.Unlock()
+		return nil
+	}
+	cfg := ps.Cfg.Clone()
+	ps.syncing = true
+	ps.Unlock()
+
+	defer func() {
+		ps.Lock()
+		ps.syncing = false
+		ps.Unlock()
+	}()
+
+	cfg.Upstreams = rc.Upstreams
+	cfg.Endpoints = rc.Endpoints
+	if _, err := ps.applyDefs(cfg); err != nil {
+		return err
+	}
+
+	ps.Lock()
+	ps.configVersion = rc.Version
+	ps.configNode = rc.Node
+	ps.overridden = true
+	ps.Unlock()
+	ps.state.Touch()
+
+	log.Printf("[cluster] applied config of %s (version %d)\n", rc.Node, rc.Version)
+	return nil
+}
+
+// mergeGate applies a remote gate record newer than the local one. The
+// replica that made the change already notified about it.
+func (us *UpstreamHandler) mergeGate(rec GateRecord) {
+	us.Lock()
+	defer us.Unlock()
+
+	var version int64
+	var node string
+	if us.gate != nil {
+		version, node = us.gate.Version, us.gate.Node
+	}
+	if !newer(rec.Version, rec.Node, version, node) {
+		return
+	}
+
+	if us.gate != nil && us.gate.timer != nil {
+		us.gate.timer.Stop()
+	}
+
+	change := rec.GateChange
+	change.prev = gateValue(rec.Previous)
+	change.timer = nil
+	if change.ExpiresAt != nil {
+		change.timer = time.AfterFunc(time.Until(*change.ExpiresAt), func() { us.expireGate(&change) })
+	}
+
+	us.gate = &change
+	us.UpdateGate(gateValue(change.State))
+
+	log.Printf("[upstream:%s] gate %s by %s via %s: %s\n", us.def.Id, change.State, change.Actor, change.Node, change.Reason)
+	us.restoreBreaker()
+	us.state.Touch()
+}
+
+func (ps *ProxyServer) AdminClusterSync(w http.ResponseWriter, r *http.Request) {
+	var remote ClusterState
+	if err := readJSON(r, &remote); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if remote.Node == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing 'node'")
+		return
+	}
+
+	ps.cluster.Merge(&remote)
+
+	writeJSON(w, http.StatusOK, ps.clusterState())
+}
+
+func (ps *ProxyServer) AdminClusterStatus(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	version, node := ps.configVersion, ps.configNode
+	ps.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"node":           ps.cluster.NodeId(),
+		"peers":          ps.cluster.Peers(),
+		"config_version": version,
+		"config_node":    node,
+	})
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestReplicas builds n servers whose admin APIs listen on local test
+// servers and which list each other as peers.
+func newTestReplicas(t *testing.T, n int) []*ProxyServer {
+	var replicas []*ProxyServer
+	var urls []string
+
+	for i := 0; i < n; i++ {
+		ps, ar := newTestAdmin(t)
+		ps.cluster.nodeId = string(rune('a' + i))
+
+		srv := httptest.NewServer(ar)
+		t.Cleanup(srv.Close)
+
+		replicas = append(replicas, ps)
+		urls = append(urls, srv.URL+"/_admin")
+	}
+
+	for i, ps := range replicas {
+		for j, u := range urls {
+			if i != j {
+				ps.cluster.peers = append(ps.cluster.peers, &ClusterPeer{URL: u})
+			}
+		}
+	}
+
+	return replicas
+}
+
+func TestClusterGateSync(t *testing.T) {
+	rs := newTestReplicas(t, 3)
+	a, b, c := rs[0], rs[1], rs[2]
+
+	a.lookupUpstream("service1").Closegate("admin:oncall", "deploy", 0)
+	a.cluster.SyncAll()
+
+	for _, ps := range []*ProxyServer{b, c} {
+		u := ps.lookupUpstream("service1")
+		if u.Handler.GetGateState() != GateClosed {
+			t.Fatalf("%s: gate not closed", ps.cluster.NodeId())
+		}
+		if g := u.Handler.GateInfo(); g.Actor != "admin:oncall" || g.Node != "a" {
+			t.Errorf("%s: got %+v", ps.cluster.NodeId(), g)
+		}
+	}
+
+	// a later change on another replica wins everywhere
+	c.lookupUpstream("service1").Opengate("admin:ci", "done", 0)
+	c.cluster.SyncAll()
+
+	for _, ps := range rs {
+		if ps.lookupUpstream("service1").Handler.GetGateState() != GateOpened {
+			t.Errorf("%s: gate not opened", ps.cluster.NodeId())
+		}
+	}
+
+	// a stale record is ignored
+	old := a.lookupUpstream("service1").Handler.gateRecord()
+	old.State, old.Version = "closed", 1
+	b.cluster.Merge(&ClusterState{Node: "z", Gates: map[string]GateRecord{"service1": old}})
+	if b.lookupUpstream("service1").Handler.GetGateState() != GateOpened {
+		t.Error("stale gate applied")
+	}
+}
+
+func TestClusterConfigSync(t *testing.T) {
+	rs := newTestReplicas(t, 2)
+	a, b := rs[0], rs[1]
+
+	if code, err := a.AddUpstream(UpstreamDef{Id: "service9", Endpoint: "http://127.0.0.1:9"}); err != nil {
+		t.Fatalf("add: %d %s", code, err)
+	}
+	a.cluster.SyncAll()
+
+	if b.lookupUpstream("service9") == nil {
+		t.Fatal("upstream not replicated")
+	}
+
+	// the change is also pulled by a replica syncing on its own
+	if code, err := a.DeleteUpstream("service9"); err != nil {
+		t.Fatalf("delete: %d %s", code, err)
+	}
+	b.cluster.SyncAll()
+
+	if b.lookupUpstream("service9") != nil {
+		t.Error("deleted upstream still present")
+	}
+}
+
+func TestClusterPeerToken(t *testing.T) {
+	ps, _ := newTestAdmin(t)
+	ps.Cfg.Server.Cluster.Token = "s3cret"
+
+	ar, err := ps.newAdminRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := doAdmin(ar, http.MethodPost, "/_admin/v1/cluster/sync", `{"node":"x"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/_admin/v1/cluster/sync", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w = httptest.NewRecorder()
+	ar.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("with token, empty body: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const DefaultCoalesceMaxBody = 1 << 20
+
+// coalescePrivate are the request headers that may change the response for
+// a single client; requests with them are coalesced only when listed.
+var coalescePrivate = []string{"Authorization", "Cookie", "Range", "If-None-Match", "If-Modified-Since"}
+
+// CoalesceDef collapses identical GET and HEAD requests in flight (same
+// method, URL and listed `headers`) into one upstream call, whose response
+// is fanned out to all of them. Responses larger than `max_body` are not
+// shared: the other requests are then sent on their own.
+type CoalesceDef struct {
+	Enabled bool     `json:"enabled"  yaml:"enabled"`
+	Headers []string `json:"headers"  yaml:"headers"`
+	MaxBody int64    `json:"max_body" yaml:"max_body"`
+}
+
+func (cd *CoalesceDef) Validate() error {
+	if cd.MaxBody < 0 {
+		return fmt.Errorf("coalesce: max_body must not be negative")
+	}
+	return nil
+}
+
+// coalescedCall is the upstream call shared by identical requests.
+type coalescedCall struct {
+	done chan struct{}
+
+	// set before done is closed, when the response is shared
+	status int
+	header http.Header
+	body   []byte
+	shared bool
+}
+
+type coalescer struct {
+	def     *CoalesceDef
+	maxBody int64
+	calls   map[string]*coalescedCall
+
+	sync.Mutex
+}
+
+func newCoalescer(cd *CoalesceDef) *coalescer {
+	c := &coalescer{def: cd, maxBody: cd.MaxBody, calls: make(map[string]*coalescedCall)}
+	if c.maxBody == 0 {
+		c.maxBody = DefaultCoalesceMaxBody
+	}
+	return c
+}
+
+// key identifies identical requests, or is empty when the request cannot
+// be coalesced.
+func (c *coalescer) key(r *http.Request) string {
+	if c == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	for _, h := range coalescePrivate {
+		if r.Header.Get(h) != "" && !containsFold(c.def.Headers, h) {
+			return ""
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(r.Method + " " + requestURI(r))
+	for _, h := range c.def.Headers {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+// join returns the call in flight for key, and whether the caller leads it
+// and must finish it.
+func (c *coalescer) join(key string) (*coalescedCall, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish shares the response of the leader with the waiting requests,
+// buffering its body. The leader's response reads the same body. A nil
+// response, or one over max_body, is not shared.
+func (c *coalescer) finish(key string, call *coalescedCall, res *http.Response) {
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+
+	defer close(call.done)
+
+	if res == nil {
+		return
+	}
+
+	bs, err := ioutil.ReadAll(io.LimitReader(res.Body, c.maxBody+1))
+	if err != nil || int64(len(bs)) > c.maxBody {
+		res.Body = &prefixBody{Reader: io.MultiReader(bytes.NewReader(bs), res.Body), Closer: res.Body}
+		return
+	}
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(bs))
+
+	call.status = res.StatusCode
+	call.header = res.Header.Clone()
+	call.body = bs
+	call.shared = true
+}
+
+// response answers a waiting request with the shared response.
+func (call *coalescedCall) response(r *http.Request) *http.Response {
+	h := call.header.Clone()
+	h.Set("X-Buffy-Coalesced", "true")
+
+	return &http.Response{
+		Request:       r,
+		Header:        h,
+		StatusCode:    call.status,
+		Status:        http.StatusText(call.status),
+		ContentLength: int64(len(call.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(call.body)),
+	}
+}
+
+// prefixBody reads what was buffered before the rest of a body.
+type prefixBody struct {
+	io.Reader
+	io.Closer
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -19,13 +20,18 @@ type BuffyConfig struct {
 	Server         ServerDef     `json:"buffy"     yaml:"buffy"`
 	Upstreams      []UpstreamDef `json:"upstreams" yaml:"upstreams"`
 	Endpoints      []EndpointDef `json:"endpoints" yaml:"endpoints"`
-	ConfigFilename string        `json:"filename"`
-	BasePath       string        `json:"basepath"`
+	ConfigFilename string        `json:"filename"  yaml:"-"`
+	BasePath       string        `json:"basepath"  yaml:"-"`
 }
 
 type ServerDef struct {
-	Listen ServerListen `json:"listen" yaml:"listen"`
-	Admin  ServerAdmin  `json:"admin"  yaml:"admin"`
+	Listen    ServerListen `json:"listen"     yaml:"listen"`
+	Admin     ServerAdmin  `json:"admin"      yaml:"admin"`
+	StateFile string       `json:"state_file" yaml:"state_file"`
+	Cluster   ClusterDef   `json:"cluster"    yaml:"cluster"`
+	// MaxInflight bounds the requests sent upstream at once by all the
+	// endpoints; the others wait in their queue. Zero means no limit.
+	MaxInflight int `json:"max_inflight" yaml:"max_inflight"`
 }
 
 type ServerListen struct {
@@ -38,6 +44,10 @@ type ServerAdmin struct {
 	Bind   string      `json:"bind"    yaml:"bind"`
 	Port   int         `json:"port"    yaml:"port"`
 	Notify AdminNotify `json:"notify"  yaml:"notify"`
+	Auth   AdminAuth   `json:"auth"    yaml:"auth"`
+	// Persist writes runtime changes made through the admin API back to
+	// the config file.
+	Persist bool `json:"persist" yaml:"persist"`
 }
 type AdminNotify struct {
 	Webhook string `json:"webhook" yaml:"webhook"`
@@ -59,7 +69,7 @@ func (ed *EndpointDef) GetResponseWithName(name string, basepath string) (int, s
 		}
 	}
 
-	return http.StatusInternalServerError, "", errors.New("not found name")
+	return http.StatusInternalServerError, "", ErrNotFoundResponse
 }
 
 func (ed *EndpointDef) ReadContentFile(filename string, basepath string) (string, error) {
@@ -80,6 +90,9 @@ func ReadConfigFile(filename string) (*BuffyConfig, error) {
 
 	var t BuffyConfig
 	err = yaml.Unmarshal(bs, &t)
+	if err == nil {
+		err = t.Validate()
+	}
 
 	t.ConfigFilename, _ = filepath.Abs(filename)
 	t.BasePath = filepath.Dir(t.ConfigFilename)
@@ -87,6 +100,73 @@ func ReadConfigFile(filename string) (*BuffyConfig, error) {
 	return &t, err
 }
 
+// Validate checks the upstreams and endpoints of a config. It is used both
+// for the YAML file and for changes made at runtime.
+func (cfg *BuffyConfig) Validate() error {
+	if cfg.Server.MaxInflight < 0 {
+		return errors.New("server: max_inflight must not be negative")
+	}
+
+	upstreams := make(map[string]bool)
+	for _, u := range cfg.Upstreams {
+		if err := u.Validate(); err != nil {
+			return err
+		}
+		if upstreams[u.Id] {
+			return errors.New("duplicated upstream id: " + u.Id)
+		}
+		upstreams[u.Id] = true
+	}
+
+	ids := make(map[string]bool)
+	paths := make(map[string]bool)
+	for _, e := range cfg.Endpoints {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		if ids[e.Id] {
+			return errors.New("duplicated endpoint id: " + e.Id)
+		}
+		if paths[e.Path] {
+			return errors.New("duplicated endpoint path: " + e.Path)
+		}
+		ids[e.Id] = true
+		paths[e.Path] = true
+
+		for _, id := range e.upstreamIds() {
+			if !upstreams[id] {
+				return fmt.Errorf("endpoint %s: not found upstream with id: %s", e.Id, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Clone returns a copy whose upstream and endpoint lists can be modified
+// without touching the original.
+func (cfg *BuffyConfig) Clone() *BuffyConfig {
+	c := *cfg
+	c.Upstreams = append([]UpstreamDef(nil), cfg.Upstreams...)
+	c.Endpoints = append([]EndpointDef(nil), cfg.Endpoints...)
+	return &c
+}
+
+// WriteConfigFile saves the config as YAML, replacing the file atomically.
+func (cfg *BuffyConfig) WriteConfigFile(filename string) error {
+	bs, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
 func (cfg *BuffyConfig) JSON() string {
 	bs, _ := json.MarshalIndent(cfg, "", "\t")
 	return string(bs)
@@ -102,6 +182,9 @@ func (cfg *BuffyConfig) ShowInfo() {
 	log.Printf("- admin     : %s:%d\n", cfg.Server.Admin.Bind, cfg.Server.Admin.Port)
 	log.Printf("- webhook   : '%s'\n", cfg.Server.Admin.Notify.Webhook)
 	log.Printf("- slack     : '%s'\n", cfg.Server.Admin.Notify.Slack)
+	log.Printf("- state     : '%s'\n", cfg.StateFilename())
+	log.Printf("- peers     : %d\n", len(cfg.Server.Cluster.Peers))
+	log.Printf("- inflight  : %d\n", cfg.Server.MaxInflight)
 
 	log.Printf("- upstreams : %d\n", len(cfg.Upstreams))
 	for _, up := range cfg.Upstreams {
@@ -110,7 +193,7 @@ func (cfg *BuffyConfig) ShowInfo() {
 
 	log.Printf("- endpoints : %d\n", len(cfg.Endpoints))
 	for _, ep := range cfg.Endpoints {
-		log.Printf("  - %s: %s timeout:%d queue:%d mode:%s\n", ep.Id, ep.Path, ep.Timeout, ep.MaxQueue, ep.ProxyMode)
+		log.Printf("  - %s: %s timeout:%s queue:%d inflight:%d mode:%s\n", ep.Id, ep.Path, ep.QueueTimeout(), ep.MaxQueue, ep.MaxInflight, ep.ProxyMode)
 	}
 
 	log.Println()
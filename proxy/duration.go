@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Duration is a config duration written as a Go duration string, e.g.
+// "1500ms" or "2m". A bare number is read in seconds, the unit of the
+// former integer `timeout`.
+type Duration time.Duration
+
+// Milliseconds is a config duration whose bare numbers are read in
+// milliseconds, the unit of the former integer `interval`.
+type Milliseconds time.Duration
+
+func parseDuration(v interface{}, unit time.Duration) (time.Duration, error) {
+	switch x := v.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return time.Duration(x) * unit, nil
+	case float64:
+		return time.Duration(x * float64(unit)), nil
+	case string:
+		if n, err := strconv.ParseFloat(x, 64); err == nil {
+			return time.Duration(n * float64(unit)), nil
+		}
+		return time.ParseDuration(x)
+	}
+	return 0, fmt.Errorf("invalid duration: %v", v)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	x, err := parseDuration(v, time.Second)
+	*d = Duration(x)
+	return err
+}
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return err
+	}
+	x, err := parseDuration(v, time.Second)
+	*d = Duration(x)
+	return err
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Milliseconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	x, err := parseDuration(v, time.Millisecond)
+	*d = Milliseconds(x)
+	return err
+}
+
+func (d *Milliseconds) UnmarshalJSON(bs []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(bs, &v); err != nil {
+		return err
+	}
+	x, err := parseDuration(v, time.Millisecond)
+	*d = Milliseconds(x)
+	return err
+}
+
+func (d Milliseconds) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d Milliseconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// formatSeconds renders a duration in seconds for X-Buffy-* headers and
+// templates, e.g. "20" or "1.5".
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDuration(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		timeout  time.Duration
+		interval time.Duration
+	}{
+		{"20", 20 * time.Second, 20 * time.Millisecond},
+		{"1.5", 1500 * time.Millisecond, 1500 * time.Microsecond},
+		{`"250ms"`, 250 * time.Millisecond, 250 * time.Millisecond},
+		{`"2m"`, 2 * time.Minute, 2 * time.Minute},
+		{`"3"`, 3 * time.Second, 3 * time.Millisecond},
+	} {
+		var y struct {
+			Timeout  Duration     `yaml:"timeout"`
+			Interval Milliseconds `yaml:"interval"`
+		}
+		if err := yaml.Unmarshal([]byte("timeout: "+tt.in+"\ninterval: "+tt.in), &y); err != nil {
+			t.Fatalf("yaml %s: %v", tt.in, err)
+		}
+		if time.Duration(y.Timeout) != tt.timeout || time.Duration(y.Interval) != tt.interval {
+			t.Errorf("yaml %s: got %v %v", tt.in, time.Duration(y.Timeout), time.Duration(y.Interval))
+		}
+
+		var j struct {
+			Timeout  Duration     `json:"timeout"`
+			Interval Milliseconds `json:"interval"`
+		}
+		if err := json.Unmarshal([]byte(`{"timeout":`+tt.in+`,"interval":`+tt.in+`}`), &j); err != nil {
+			t.Fatalf("json %s: %v", tt.in, err)
+		}
+		if j.Timeout != y.Timeout || j.Interval != y.Interval {
+			t.Errorf("json %s: got %v %v", tt.in, time.Duration(j.Timeout), time.Duration(j.Interval))
+		}
+	}
+
+	var d Duration
+	if err := yaml.Unmarshal([]byte("soon"), &d); err == nil {
+		t.Error("invalid duration accepted")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -25,10 +26,33 @@ type EndpointDef struct {
 	Type      string                `json:"type"       yaml:"type"`
 	Upstream  []string              `json:"upstream"   yaml:"upstream"`
 	ProxyMode string                `json:"proxy_mode" yaml:"proxy_mode"`
-	Timeout   int                   `json:"timeout"    yaml:"timeout"`
+	Timeout   Duration              `json:"timeout"    yaml:"timeout"`
+	Timeouts  TimeoutsDef           `json:"timeouts"   yaml:"timeouts"`
 	MaxQueue  int                   `json:"max_queue"  yaml:"max_queue"`
 	Methods   []string              `json:"methods"    yaml:"methods"`
+	Queue     QueueDef              `json:"queue"      yaml:"queue"`
+	Retry     RetryDef              `json:"retry"      yaml:"retry"`
+	Outlier   OutlierDef            `json:"outlier"    yaml:"outlier"`
+	Fallback  []FallbackDef         `json:"fallback"   yaml:"fallback"`
+	Cache     CacheDef              `json:"cache"      yaml:"cache"`
+	Coalesce  CoalesceDef           `json:"coalesce"   yaml:"coalesce"`
+	RateLimit RateLimitDef          `json:"rate_limit" yaml:"rate_limit"`
 	Response  []EndpointResponseDef `json:"response"   yaml:"response"`
+	// MaxInflight bounds the requests sent upstream at once; the others
+	// wait in the queue. Zero means no limit, as for max_queue.
+	MaxInflight int `json:"max_inflight" yaml:"max_inflight"`
+	// DeliverAbandoned sends a store_and_forward request upstream even
+	// if its client left while it was held.
+	DeliverAbandoned bool `json:"deliver_abandoned" yaml:"deliver_abandoned"`
+}
+
+// TimeoutsDef bounds each stage of a proxied request. Zero means no limit,
+// except for the queue wait which defaults to `timeout`.
+type TimeoutsDef struct {
+	Queue          Duration `json:"queue"           yaml:"queue"`
+	Connect        Duration `json:"connect"         yaml:"connect"`
+	ResponseHeader Duration `json:"response_header" yaml:"response_header"`
+	Total          Duration `json:"total"           yaml:"total"`
 }
 
 type EndpointResponseDef struct {
@@ -43,6 +67,17 @@ type EndpointHandler struct {
 	upstream *Upstream
 	notiC    chan string
 	handler  http.HandlerFunc
+	metrics  *Metrics
+	queue    *EndpointQueue
+
+	transport http.RoundTripper
+	fallbacks []*fallback
+	cache     *responseCache
+	coalescer *coalescer
+	limiter   *rateLimiter
+
+	// the endpoint replacing this one at runtime
+	successor *EndpointHandler
 
 	MaxConn int                   `json:"maxconn"`
 	CurConn int                   `json:"curconn"`
@@ -52,11 +87,99 @@ type EndpointHandler struct {
 	sync.Mutex
 }
 
+type CtxKeyEndpoint struct{}
+
+var ctxKeyEndpoint CtxKeyEndpoint
+
+// endpointFromContext returns the endpoint a proxied request came through.
+func endpointFromContext(ctx context.Context) *EndpointHandler {
+	eh, _ := ctx.Value(ctxKeyEndpoint).(*EndpointHandler)
+	return eh
+}
+
 type ConnState struct {
 	RemoteAddr string `json:"remote_addr"`
 	CreatedAt  int64  `json:"created_at"`
 }
 
+// QueueTimeout is how long a request may wait for the upstream.
+func (e *EndpointDef) QueueTimeout() time.Duration {
+	if e.Timeouts.Queue > 0 {
+		return time.Duration(e.Timeouts.Queue)
+	}
+	return time.Duration(e.Timeout)
+}
+
+func (e *EndpointDef) Validate() error {
+	if e.Id == "" {
+		return errors.New("endpoint: missing 'id'")
+	}
+
+	if !strings.HasPrefix(e.Path, "/") {
+		return fmt.Errorf("endpoint %s: path must start with '/': %q", e.Id, e.Path)
+	}
+
+	switch e.Type {
+	case TypeRespond:
+	case TypeProxy:
+		if len(e.Upstream) == 0 {
+			return fmt.Errorf("endpoint %s: must provide 'upstream'", e.Id)
+		}
+		switch e.ProxyMode {
+		case ProxyModeStoreAndForward, ProxyModeBypass:
+		default:
+			return fmt.Errorf("endpoint %s: invalid proxy mode: %q", e.Id, e.ProxyMode)
+		}
+	default:
+		return fmt.Errorf("endpoint %s: invalid type: %q", e.Id, e.Type)
+	}
+
+	if e.Timeout < 0 || e.MaxQueue < 0 || e.MaxInflight < 0 {
+		return fmt.Errorf("endpoint %s: timeout, max_queue and max_inflight must not be negative", e.Id)
+	}
+
+	ts := e.Timeouts
+	if ts.Queue < 0 || ts.Connect < 0 || ts.ResponseHeader < 0 || ts.Total < 0 {
+		return fmt.Errorf("endpoint %s: timeouts must not be negative", e.Id)
+	}
+
+	if e.DeliverAbandoned && e.ProxyMode != ProxyModeStoreAndForward {
+		return fmt.Errorf("endpoint %s: deliver_abandoned requires proxy_mode %s", e.Id, ProxyModeStoreAndForward)
+	}
+
+	if err := e.Cache.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	if err := e.Coalesce.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	if err := e.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	for i := range e.Fallback {
+		if err := e.Fallback[i].Validate(e); err != nil {
+			return fmt.Errorf("endpoint %s: %s", e.Id, err)
+		}
+	}
+
+	if err := e.Outlier.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	if err := e.Retry.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	if err := e.Queue.Validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %s", e.Id, err)
+	}
+
+	return nil
+}
+
 func NewEndpoint(ctx context.Context, e EndpointDef, notiC chan string) (*Endpoint, error) {
 	ep := &Endpoint{
 		Id:   e.Id,
@@ -66,94 +189,135 @@ func NewEndpoint(ctx context.Context, e EndpointDef, notiC chan string) (*Endpoi
 			ctx:      ctx,
 			notiC:    notiC,
 			def:      &e,
+			metrics:  metricsFromContext(ctx),
 			MaxConn:  e.MaxQueue,
 			CurConn:  0,
 			upstream: nil,
 			Conns:    make(map[string]*ConnState),
+			limiter:  newRateLimiter(e.RateLimit, e.Path),
 		},
 	}
 	return ep, nil
 }
 
-func (eh *EndpointHandler) RegisterRoute(mux *http.ServeMux, upstream *Upstream) error {
+// SetFallbacks attaches the fallbacks of the endpoint, with their
+// upstreams by id.
+func (eh *EndpointHandler) SetFallbacks(upstreams []*Upstream) {
+	eh.fallbacks = nil
+	for i := range eh.def.Fallback {
+		fb := &fallback{def: &eh.def.Fallback[i]}
+		for _, up := range upstreams {
+			if up.Id == fb.def.Upstream {
+				fb.upstream = up
+			}
+		}
+		eh.fallbacks = append(eh.fallbacks, fb)
+	}
+}
+
+func (eh *EndpointHandler) RegisterRoute(upstreams []*Upstream) error {
 	epf := eh.def
-	cfg := eh.ctx.Value(ctxKeyConfig).(*BuffyConfig)
 
 	var _handle http.HandlerFunc
 
 	switch epf.Type {
 	case TypeProxy:
-		if upstream == nil {
+		if len(upstreams) == 0 {
 			return errors.New("must provide 'upstream'")
 		}
 
-		// attach the upstream
-		eh.upstream = upstream
-		if err := eh.upstream.CreateReverseProxy(epf.ProxyMode, epf.Timeout); err != nil {
+		// attach the upstreams; requests go through the first one's
+		// reverse proxy and are released to any of them in turn
+		eh.upstream = upstreams[0]
+		if err := eh.upstream.CreateReverseProxy(); err != nil {
 			return err
 		}
 
+		queue, err := NewEndpointQueue(epf, upstreams)
+		if err != nil {
+			return err
+		}
+		if epf.Outlier.enabled() {
+			queue.outlier = newOutlierDetector(epf, upstreams, eh.notify, eh.metrics)
+		}
+		queue.global = inflightFromContext(eh.ctx)
+		eh.queue = queue
+		eh.transport = newEndpointTransport(&epf.Timeouts)
+		if epf.Cache.enabled() {
+			cfg := eh.ctx.Value(ctxKeyConfig).(*BuffyConfig)
+			eh.cache = newResponseCache(&epf.Cache, cfg.BasePath)
+		}
+		if epf.Coalesce.Enabled {
+			eh.coalescer = newCoalescer(&epf.Coalesce)
+		}
+
 		_handle = func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("[endpoint(%d):%s:'%s'] %s\n", atomic.AddUint32(&eh.Counter, 1), epf.Id, epf.Desc, r.URL)
+			// tracked under its unique id until answered
+			id := eh.In(r)
+			defer eh.Out(id)
+			log.Printf("[endpoint(%d):%s:'%s'] %s id=%s\n", atomic.AddUint32(&eh.Counter, 1), epf.Id, epf.Desc, r.URL, id)
 
-			var code int
-			var content string
-			var err error
+			rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			w = rec
+			defer eh.observe(rec, time.Now())
 
-			if eh.IsReachedMaxQueue() {
-				code, content, err = epf.GetResponseWithName(NameHitMaxQueue, cfg.BasePath)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("buffy[yaml]: not found a response body for code 'hit_max_queue' : " + err.Error()))
-					return
-				}
-			} else {
-				// forward the request with the replacement of hostname
-				sid := eh.In(r)
-				// IMPORTANT
-				r.Host = r.URL.Host
-				r.Header.Add("X-Buffy-URL", r.RequestURI)
-				r.Header.Add("X-Buffy-Endpoint-ID", epf.Id)
-				r.Header.Add("X-Buffy-Way", "up")
-				eh.upstream.Forward(w, r)
-				eh.Out(sid)
+			if eh.rateLimited(w, r) {
 				return
 			}
 
-			// add default headers
-			eh.addHeaders(w, r, epf)
+			if eh.IsReachedMaxQueue() {
+				eh.metrics.Inc(MetricMaxQueueRejectionTotal, epf.Id, eh.UpstreamId())
+				eh.writeResponse(w, r, NameHitMaxQueue, nil)
+				return
+			}
 
-			w.WriteHeader(code)
-			w.Write([]byte(content))
+			// forward the request with the replacement of hostname
+			// IMPORTANT
+			r.Host = r.URL.Host
+			for k := range r.Header {
+				// only buffy sets its headers
+				if strings.HasPrefix(k, "X-Buffy-") {
+					r.Header.Del(k)
+				}
+			}
+			r.Header.Set("X-Buffy-URL", r.RequestURI)
+			r.Header.Set("X-Buffy-Endpoint-ID", epf.Id)
+			r.Header.Set("X-Buffy-Way", "up")
+			if epf.DeliverAbandoned {
+				var err error
+				if r, err = detach(r); err != nil {
+					w.Header().Set(HeaderRequestID, id)
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("buffy: failed to store the request body: " + err.Error()))
+					return
+				}
+			}
+			ctx := context.WithValue(r.Context(), ctxKeyEndpoint, eh)
+			if epf.Timeouts.Total > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(epf.Timeouts.Total))
+				defer cancel()
+			}
+			eh.upstream.Forward(w, r.WithContext(ctx))
 		}
 
 	case TypeRespond:
 		_handle = func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("[endpoint(%d):%s:'%s'] %s\n", atomic.AddUint32(&eh.Counter, 1), epf.Id, epf.Desc, r.URL)
+			id := setRequestID(r, nil)
+			log.Printf("[endpoint(%d):%s:'%s'] %s id=%s\n", atomic.AddUint32(&eh.Counter, 1), epf.Id, epf.Desc, r.URL, id)
 
-			var code int
-			var content string
-			var err error
+			rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			w = rec
+			defer eh.observe(rec, time.Now())
 
-			code, content, err = epf.GetResponseWithName(NameOK, cfg.BasePath)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("buffy[yaml]: not found a response body for code 200 : " + err.Error()))
+			if eh.rateLimited(w, r) {
 				return
 			}
 
-			// process template
-			content = eh.processTemplate(w, r, epf, content)
-
-			// add default headers
-			eh.addHeaders(w, r, epf)
-
-			w.WriteHeader(code)
-			w.Write([]byte(content))
+			eh.writeResponse(w, r, NameOK, nil)
 		}
 	}
 
-	mux.HandleFunc(epf.Path, _handle)
 	eh.handler = _handle
 
 	return nil
@@ -162,12 +326,9 @@ func (eh *EndpointHandler) RegisterRoute(mux *http.ServeMux, upstream *Upstream)
 func (eh *EndpointHandler) addHeaders(w http.ResponseWriter, r *http.Request, epf *EndpointDef) {
 	w.Header().Add("X-Buffy-URL", r.RequestURI)
 	w.Header().Add("X-Buffy-Endpoint-ID", epf.Id)
-}
-
-func (eh *EndpointHandler) processTemplate(w http.ResponseWriter, r *http.Request, epf *EndpointDef, content string) string {
-	content = strings.ReplaceAll(content, "{{URL}}", r.RequestURI)
-	content = strings.ReplaceAll(content, "{{ID}}", epf.Id)
-	return content
+	if id := r.Header.Get(HeaderRequestID); id != "" {
+		w.Header().Set(HeaderRequestID, id)
+	}
 }
 
 func (eh *EndpointHandler) notify(msg string) {
@@ -176,16 +337,17 @@ func (eh *EndpointHandler) notify(msg string) {
 	}
 }
 
+// In gives a request an id unique among those tracked by the endpoint,
+// and tracks it until Out.
 func (eh *EndpointHandler) In(r *http.Request) string {
 	eh.Lock()
 	defer eh.Unlock()
 
-	ts := time.Now().Unix()
-	sid := fmt.Sprintf("%x-%s", ts, r.RemoteAddr)
-	eh.Conns[sid] = &ConnState{RemoteAddr: r.RemoteAddr, CreatedAt: ts}
-	eh.CurConn++
+	id := setRequestID(r, func(id string) bool { return eh.Conns[id] != nil })
+	eh.Conns[id] = &ConnState{RemoteAddr: r.RemoteAddr, CreatedAt: time.Now().Unix()}
+	eh.CurConn = len(eh.Conns)
 
-	return sid
+	return id
 }
 
 func (eh *EndpointHandler) MarshalJSON() ([]byte, error) {
@@ -197,11 +359,15 @@ func (eh *EndpointHandler) MarshalJSON() ([]byte, error) {
 		CurConn int                   `json:"curconn"`
 		Counter uint32                `json:"counter"`
 		Conns   map[string]*ConnState `json:"conns"`
+		Lanes   map[string]int        `json:"lanes"`
+		Members []MemberInfo          `json:"members,omitempty"`
 	}{
 		MaxConn: eh.MaxConn,
 		CurConn: eh.CurConn,
 		Counter: eh.Counter,
 		Conns:   eh.Conns,
+		Lanes:   eh.queue.Depth(),
+		Members: eh.queue.Members(),
 	})
 }
 
@@ -222,16 +388,51 @@ func (eh *EndpointHandler) Out(sid string) {
 	defer eh.Unlock()
 
 	delete(eh.Conns, sid)
-	eh.CurConn--
+	eh.CurConn = len(eh.Conns)
 }
 
-func (eh *EndpointHandler) IsReachedMaxQueue() bool {
+func (eh *EndpointHandler) QueueDepth() int {
 	eh.Lock()
 	defer eh.Unlock()
 
-	if eh.CurConn < eh.MaxConn {
+	return eh.CurConn
+}
+
+func (eh *EndpointHandler) UpstreamId() string {
+	if eh.upstream == nil {
+		return ""
+	}
+	return eh.upstream.Id
+}
+
+func (eh *EndpointHandler) observe(rec *statusRecorder, st time.Time) {
+	eh.metrics.Inc(MetricRequestsTotal, eh.def.Id, eh.UpstreamId(), strconv.Itoa(rec.code))
+	eh.metrics.Observe(MetricRequestDuration, time.Since(st).Seconds(), eh.def.Id, eh.UpstreamId())
+}
+
+// statusRecorder keeps the status code written to the client for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.code = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// IsReachedMaxQueue reports whether max_queue requests are waiting
+// already. Requests in flight do not count.
+func (eh *EndpointHandler) IsReachedMaxQueue() bool {
+	if eh.MaxConn == 0 || eh.queue == nil {
 		return false
 	}
 
-	return true
+	return eh.queue.Len() >= eh.MaxConn
 }
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FallbackDef takes the requests of an endpoint right away while none of
+// its upstreams can take them (gate closed or unavailable), instead of
+// holding them: either another `upstream`, e.g. a read-only replica, or a
+// named `response`. It applies to the listed `methods`, or to all of them.
+type FallbackDef struct {
+	Methods  []string `json:"methods"  yaml:"methods"`
+	Upstream string   `json:"upstream" yaml:"upstream"`
+	Response string   `json:"response" yaml:"response"`
+}
+
+type fallback struct {
+	def      *FallbackDef
+	upstream *Upstream
+}
+
+func (fd *FallbackDef) Validate(e *EndpointDef) error {
+	if (fd.Upstream == "") == (fd.Response == "") {
+		return fmt.Errorf("fallback: requires either 'upstream' or 'response'")
+	}
+
+	if fd.Response != "" {
+		if _, ok := DefaultResponses[fd.Response]; ok {
+			return nil
+		}
+		for _, res := range e.Response {
+			if res.Name == fd.Response {
+				return nil
+			}
+		}
+		return fmt.Errorf("fallback: not found response: %s", fd.Response)
+	}
+
+	return nil
+}
+
+func (fd *FallbackDef) match(r *http.Request) bool {
+	if len(fd.Methods) == 0 {
+		return true
+	}
+	for _, m := range fd.Methods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamIds returns every upstream an endpoint sends requests to.
+func (e *EndpointDef) upstreamIds() []string {
+	ids := append([]string(nil), e.Upstream...)
+	for _, fb := range e.Fallback {
+		if fb.Upstream != "" {
+			ids = append(ids, fb.Upstream)
+		}
+	}
+	return ids
+}
+
+// fallbackFor returns the first fallback of the request's method.
+func (eh *EndpointHandler) fallbackFor(r *http.Request) *fallback {
+	for _, fb := range eh.fallbacks {
+		if fb.def.match(r) {
+			return fb
+		}
+	}
+	return nil
+}
+
+// take lets the fallback take a request right away while the upstreams of
+// the endpoint cannot. A fallback upstream holds an in-flight slot, as if
+// released from the queue, and counts against the max_inflight of the
+// endpoint and the server: past them, the request waits in the queue.
+func (fb *fallback) take(q *EndpointQueue) bool {
+	if fb == nil || q.ready() {
+		return false
+	}
+	if fb.upstream == nil {
+		return true
+	}
+
+	if !q.inflight.take() {
+		return false
+	}
+	if !q.global.take() {
+		q.inflight.done()
+		return false
+	}
+	if ok, _ := fb.upstream.Handler.admit(time.Now()); !ok {
+		q.inflight.done()
+		q.global.done()
+		return false
+	}
+	return true
+}
+
+// ready reports whether any upstream of the queue is open and available.
+func (q *EndpointQueue) ready() bool {
+	for _, m := range q.members {
+		if m.Handler.GetGateState() == GateOpened && m.Handler.GetUpstreamStatus() == StatusAvailable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Actors recorded with a gate change. Most are followed by an identifier,
+// e.g. "admin:ci" or "schedule:nightly-migration". The `autogate` of an
+// upstream is not evaluated yet, so it changes no gate.
+const (
+	ActorSystem   = "system"
+	ActorAdmin    = "admin"
+	ActorSchedule = "schedule"
+	ActorTTL      = "ttl"
+	ActorBreaker  = "breaker"
+)
+
+// GateChange records who changed a gate, why, and when it reverts.
+type GateChange struct {
+	State     string     `json:"state"`
+	Actor     string     `json:"actor"`
+	Reason    string     `json:"reason,omitempty"`
+	ChangedAt time.Time  `json:"changed_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   int64      `json:"version,omitempty"`
+	Node      string     `json:"node,omitempty"`
+
+	prev  uint32
+	timer *time.Timer
+}
+
+func actorWithId(kind, id string) string {
+	if id == "" {
+		return kind
+	}
+	return kind + ":" + id
+}
+
+// SetGate changes the gate and records the change. With a ttl, the gate
+// reverts to its previous state once the ttl elapses unless it was changed
+// again in the meantime.
+func (us *UpstreamHandler) SetGate(g uint32, actor, reason string, ttl time.Duration) {
+	us.Lock()
+	defer us.Unlock()
+
+	us.setGate(g, actor, reason, ttl)
+}
+
+// setGate is SetGate for callers holding the lock.
+func (us *UpstreamHandler) setGate(g uint32, actor, reason string, ttl time.Duration) {
+	if us.gate != nil && us.gate.timer != nil {
+		us.gate.timer.Stop()
+	}
+
+	change := &GateChange{
+		State:     gateName(g),
+		Actor:     actor,
+		Reason:    reason,
+		ChangedAt: time.Now(),
+		Node:      us.cluster.NodeId(),
+		prev:      us.GetGateState(),
+	}
+	change.Version = change.ChangedAt.UnixNano()
+
+	if ttl > 0 {
+		expires := change.ChangedAt.Add(ttl)
+		change.ExpiresAt = &expires
+		change.timer = time.AfterFunc(ttl, func() { us.expireGate(change) })
+	}
+
+	if actor != ActorBreaker {
+		us.resetBreaker(actor)
+	}
+
+	us.gate = change
+	us.UpdateGate(g)
+
+	log.Printf("[upstream:%s] gate %s by %s: %s\n", us.def.Id, change.State, actor, reason)
+	us.notifyGate(change)
+	us.state.Touch()
+	us.cluster.Touch()
+}
+
+func (us *UpstreamHandler) expireGate(change *GateChange) {
+	us.Lock()
+	defer us.Unlock()
+
+	// changed again since
+	if us.gate != change {
+		return
+	}
+
+	us.setGate(change.prev, ActorTTL, "expired: "+change.Reason, 0)
+}
+
+// inheritGate takes over the gate of an upstream replaced at runtime,
+// keeping its record and remaining ttl.
+func (us *UpstreamHandler) inheritGate(from *UpstreamHandler) {
+	from.Lock()
+	if from.gate != nil && from.gate.timer != nil {
+		from.gate.timer.Stop()
+	}
+	from.Unlock()
+	from.stopBreaker()
+
+	us.restoreGate(from.gateRecord())
+}
+
+// restoreGate applies a saved gate record. A ttl that elapsed in the
+// meantime reverts the gate right away. A gate closed by the breaker
+// re-arms it.
+func (us *UpstreamHandler) restoreGate(rec GateRecord) {
+	us.Lock()
+	defer us.Unlock()
+
+	if rec.ExpiresAt != nil && !time.Now().Before(*rec.ExpiresAt) {
+		us.setGate(gateValue(rec.Previous), ActorTTL, "expired: "+rec.Reason, 0)
+		return
+	}
+
+	change := rec.GateChange
+	change.prev = gateValue(rec.Previous)
+	change.timer = nil
+	if change.ExpiresAt != nil {
+		change.timer = time.AfterFunc(time.Until(*change.ExpiresAt), func() { us.expireGate(&change) })
+	}
+
+	us.gate = &change
+	us.UpdateGate(gateValue(change.State))
+	us.restoreBreaker()
+}
+
+// gateRecord returns the gate change together with the state it reverts to.
+func (us *UpstreamHandler) gateRecord() GateRecord {
+	us.Lock()
+	defer us.Unlock()
+
+	if us.gate == nil {
+		g := gateName(us.GetGateState())
+		return GateRecord{GateChange: GateChange{State: g, Actor: ActorSystem}, Previous: g}
+	}
+
+	rec := GateRecord{GateChange: *us.gate, Previous: gateName(us.gate.prev)}
+	rec.timer = nil
+	return rec
+}
+
+// GateInfo returns the last recorded gate change.
+func (us *UpstreamHandler) GateInfo() GateChange {
+	us.Lock()
+	defer us.Unlock()
+
+	if us.gate == nil {
+		return GateChange{State: gateName(us.GetGateState()), Actor: ActorSystem}
+	}
+	return *us.gate
+}
+
+func (us *UpstreamHandler) notifyGate(change *GateChange) {
+	bs, _ := json.Marshal(struct {
+		Status   string `json:"status"`
+		Upstream string `json:"upstream"`
+		*GateChange
+	}{
+		Status:     "gate",
+		Upstream:   us.def.Id,
+		GateChange: change,
+	})
+	us.notify(string(bs))
+}
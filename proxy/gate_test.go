@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGateExpiry(t *testing.T) {
+	us := &UpstreamHandler{
+		def:       &UpstreamDef{Id: "service1"},
+		notiC:     make(chan string, 10),
+		GateState: GateOpened,
+	}
+
+	us.SetGate(GateClosed, "admin:oncall", "deploy", 50*time.Millisecond)
+
+	info := us.GateInfo()
+	if info.State != "closed" || info.Actor != "admin:oncall" || info.Reason != "deploy" || info.ExpiresAt == nil {
+		t.Errorf("unexpected gate record: %+v", info)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	info = us.GateInfo()
+	if us.GetGateState() != GateOpened || info.Actor != ActorTTL {
+		t.Errorf("gate should have reverted: %+v", info)
+	}
+
+	// a later change cancels the pending revert
+	us.SetGate(GateClosed, "admin:oncall", "deploy", 50*time.Millisecond)
+	us.SetGate(GateClosed, "admin:oncall", "hold", 0)
+	time.Sleep(150 * time.Millisecond)
+
+	if us.GetGateState() != GateClosed {
+		t.Error("gate should stay closed")
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightLimit counts the requests released from the queues to the
+// upstreams, for an endpoint (`max_inflight`) or the whole server
+// (`server.max_inflight`). Requests over the limit wait in their queue.
+// Zero means no limit.
+type inflightLimit struct {
+	max   int
+	count int
+
+	changed chan struct{}
+
+	sync.Mutex
+}
+
+type CtxKeyInflight struct{}
+
+var ctxKeyInflight CtxKeyInflight
+
+func newInflightLimit(max int) *inflightLimit {
+	return &inflightLimit{max: max}
+}
+
+// inflightFromContext returns the server-wide limit.
+func inflightFromContext(ctx context.Context) *inflightLimit {
+	l, _ := ctx.Value(ctxKeyInflight).(*inflightLimit)
+	return l
+}
+
+// take counts a request in flight unless the limit is reached.
+func (l *inflightLimit) take() bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.max > 0 && l.count >= l.max {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// force counts a request in flight whatever the limit, for a request
+// released through the admin API.
+func (l *inflightLimit) force() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.count++
+}
+
+// carry counts the requests in flight of the limit of an endpoint replaced
+// at runtime, which free their slot here.
+func (l *inflightLimit) carry(from *inflightLimit) {
+	n := from.Inflight()
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.count += n
+}
+
+// done frees the slot taken by take, waking up the queues waiting for it.
+func (l *inflightLimit) done() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.count--
+	l.broadcast()
+}
+
+// broadcast wakes up everyone watching the limit. The caller must hold the
+// lock.
+func (l *inflightLimit) broadcast() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// full reports whether the limit is reached.
+func (l *inflightLimit) full() bool {
+	if l == nil {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.max > 0 && l.count >= l.max
+}
+
+// watch returns a channel closed when a slot is freed.
+func (l *inflightLimit) watch() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
+
+// Inflight returns the number of requests in flight.
+func (l *inflightLimit) Inflight() int {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.count
+}
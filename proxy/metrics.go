@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MetricRequestsTotal          = "buffy_requests_total"
+	MetricRequestDuration        = "buffy_request_duration_seconds"
+	MetricQueueDepth             = "buffy_queue_depth"
+	MetricQueueWait              = "buffy_queue_wait_seconds"
+	MetricQueueLaneDepth         = "buffy_queue_lane_depth"
+	MetricInflight               = "buffy_inflight"
+	MetricTimeoutsTotal          = "buffy_timeouts_total"
+	MetricAbandonedTotal         = "buffy_abandoned_total"
+	MetricRetriesTotal           = "buffy_retries_total"
+	MetricOutlierEjectionsTotal  = "buffy_outlier_ejections_total"
+	MetricFallbacksTotal         = "buffy_fallbacks_total"
+	MetricCacheRequestsTotal     = "buffy_cache_requests_total"
+	MetricCoalescedTotal         = "buffy_coalesced_total"
+	MetricRateLimitedTotal       = "buffy_rate_limited_total"
+	MetricRateLimitClients       = "buffy_rate_limit_clients"
+	MetricMaxQueueRejectionTotal = "buffy_max_queue_rejections_total"
+	MetricGateState              = "buffy_gate_state"
+	MetricUpstreamStatus         = "buffy_upstream_status"
+	MetricBreakerState           = "buffy_breaker_state"
+)
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// Metrics is a minimal registry that renders the Prometheus text exposition
+// format. Every series is labeled by its family's label names, in order.
+type Metrics struct {
+	families map[string]*metricFamily
+
+	sync.Mutex
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	values  []string
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+
+	m.register(MetricRequestsTotal, "Number of requests handled by an endpoint.", metricCounter, []string{"endpoint", "upstream", "code"}, nil)
+	m.register(MetricRequestDuration, "Time spent handling a request, including the time held in the buffer.", metricHistogram, []string{"endpoint", "upstream"}, DefaultBuckets)
+	m.register(MetricQueueDepth, "Number of requests currently held by an endpoint.", metricGauge, []string{"endpoint", "upstream"}, nil)
+	m.register(MetricQueueLaneDepth, "Number of requests waiting for the upstream, per lane of the endpoint's queue.", metricGauge, []string{"endpoint", "lane"}, nil)
+	m.register(MetricInflight, "Number of requests released to the upstreams of an endpoint and not finished yet.", metricGauge, []string{"endpoint"}, nil)
+	m.register(MetricQueueWait, "Time a request waited in the buffer before it was sent upstream.", metricHistogram, []string{"endpoint", "upstream"}, DefaultBuckets)
+	m.register(MetricTimeoutsTotal, "Number of requests that timed out while waiting in the buffer.", metricCounter, []string{"endpoint", "upstream"}, nil)
+	m.register(MetricAbandonedTotal, "Number of requests whose client left while they were held (delivered: sent upstream anyway).", metricCounter, []string{"endpoint", "upstream", "delivered"}, nil)
+	m.register(MetricRetriesTotal, "Number of requests sent upstream again after a failed attempt.", metricCounter, []string{"endpoint", "upstream"}, nil)
+	m.register(MetricOutlierEjectionsTotal, "Number of times an upstream of an endpoint was ejected as an outlier.", metricCounter, []string{"endpoint", "upstream"}, nil)
+	m.register(MetricFallbacksTotal, "Number of requests taken by a fallback upstream or response while no upstream could.", metricCounter, []string{"endpoint", "fallback"}, nil)
+	m.register(MetricCacheRequestsTotal, "Number of requests looked up in the cache of an endpoint (result: hit, stale, revalidated, miss).", metricCounter, []string{"endpoint", "result"}, nil)
+	m.register(MetricCoalescedTotal, "Number of requests answered with the response of an identical request in flight.", metricCounter, []string{"endpoint"}, nil)
+	m.register(MetricRateLimitedTotal, "Number of requests rejected because their client was over the rate limit of the endpoint.", metricCounter, []string{"endpoint"}, nil)
+	m.register(MetricRateLimitClients, "Number of clients tracked by the rate limit of an endpoint.", metricGauge, []string{"endpoint"}, nil)
+	m.register(MetricMaxQueueRejectionTotal, "Number of requests rejected because max_queue was reached.", metricCounter, []string{"endpoint", "upstream"}, nil)
+	m.register(MetricGateState, "Gate state of an upstream (1: opened, 0: closed).", metricGauge, []string{"upstream"}, nil)
+	m.register(MetricUpstreamStatus, "Health status of an upstream (0: none, 1: unavailable, 2: available).", metricGauge, []string{"upstream"}, nil)
+	m.register(MetricBreakerState, "Circuit breaker state of an upstream (0: closed, 1: open, 2: half open).", metricGauge, []string{"upstream"}, nil)
+
+	return m
+}
+
+func (m *Metrics) register(name, help, kind string, labels []string, buckets []float64) {
+	m.families[name] = &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+func (m *Metrics) lookup(name string, values []string) *metricSeries {
+	f, ok := m.families[name]
+	if !ok || len(values) != len(f.labels) {
+		return nil
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		if f.kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Inc adds one to a counter.
+func (m *Metrics) Inc(name string, values ...string) {
+	m.Add(name, 1, values...)
+}
+
+// Add adds v to a counter.
+func (m *Metrics) Add(name string, v float64, values ...string) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if s := m.lookup(name, values); s != nil {
+		s.value += v
+	}
+}
+
+// Set sets the current value of a gauge.
+func (m *Metrics) Set(name string, v float64, values ...string) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if s := m.lookup(name, values); s != nil {
+		s.value = v
+	}
+}
+
+// Observe records a sample in a histogram.
+func (m *Metrics) Observe(name string, v float64, values ...string) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		return
+	}
+
+	if s := m.lookup(name, values); s != nil {
+		for i, b := range f.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.samples++
+	}
+}
+
+// Reset drops every series of a family. Gauges that mirror the current
+// state are reset before being collected so removed ids disappear.
+func (m *Metrics) Reset(name string) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if f, ok := m.families[name]; ok {
+		f.series = make(map[string]*metricSeries)
+	}
+}
+
+// Value returns the current value of a counter or gauge series.
+func (m *Metrics) Value(name string, values ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		return 0
+	}
+
+	if s, ok := f.series[strings.Join(values, "\xff")]; ok {
+		return s.value
+	}
+
+	return 0
+}
+
+// WriteTo renders all families in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var sb strings.Builder
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := m.families[name]
+
+		fmt.Fprintf(&sb, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+
+			if f.kind != metricHistogram {
+				fmt.Fprintf(&sb, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.value))
+				continue
+			}
+
+			for i, b := range f.buckets {
+				fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatFloat(b)), s.counts[i])
+			}
+			fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), s.samples)
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", ""), s.samples)
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+"="+quoteLabel(values[i]))
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+"="+quoteLabel(extraValue))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// labelEscaper escapes label values as the text format expects: only
+// backslashes, double quotes and newlines.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+
+	m.Inc(MetricRequestsTotal, "example1", "service1", "200")
+	m.Inc(MetricRequestsTotal, "example1", "service1", "200")
+	m.Observe(MetricQueueWait, 0.3, "example1", "service1")
+	m.Set(MetricGateState, 1, "service1")
+
+	var sb strings.Builder
+	if _, err := m.WriteTo(&sb); err != nil {
+		t.Error(err)
+		return
+	}
+	out := sb.String()
+
+	for _, want := range []string{
+		`# TYPE buffy_requests_total counter`,
+		`buffy_requests_total{endpoint="example1",upstream="service1",code="200"} 2`,
+		`buffy_queue_wait_seconds_bucket{endpoint="example1",upstream="service1",le="0.25"} 0`,
+		`buffy_queue_wait_seconds_bucket{endpoint="example1",upstream="service1",le="0.5"} 1`,
+		`buffy_queue_wait_seconds_count{endpoint="example1",upstream="service1"} 1`,
+		`buffy_gate_state{upstream="service1"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsQueueDepth(t *testing.T) {
+	ps, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {}, EndpointDef{Timeout: Duration(200 * time.Millisecond)})
+	q := ps.lookupEndpoint("held").Handler.queue
+
+	scrape := func() string {
+		ps.collectMetrics()
+		var sb strings.Builder
+		ps.metrics.WriteTo(&sb)
+		return sb.String()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "/held", nil)
+		r.Header.Set("X-Buffy-Endpoint-ID", "spoofed")
+		ps.ServeProxy(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	for q.Len() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if out := scrape(); !strings.Contains(out, `buffy_queue_depth{endpoint="held",upstream="held"} 1`) {
+		t.Errorf("held request not counted in:\n%s", out)
+	}
+
+	<-done
+	out := scrape()
+	for _, want := range []string{
+		`buffy_queue_depth{endpoint="held",upstream="held"} 0`,
+		`buffy_timeouts_total{endpoint="held",upstream="held"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "spoofed") {
+		t.Errorf("label taken from the request:\n%s", out)
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	got := formatLabels([]string{"endpoint"}, []string{"a\"b\nc\\dé"}, "", "")
+	if want := `{endpoint="a\"b\nc\\dé"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const (
-	MaxNotifyBuffer = 1000
+	MaxNotifyBuffer     = 1000
+	MaxSubscriberBuffer = 100
 )
 
 type NotifyManager struct {
@@ -19,6 +21,9 @@ type NotifyManager struct {
 	slack   string
 
 	C chan string
+
+	subscribers map[chan string]struct{}
+	sync.Mutex
 }
 
 func NewNotifyManager(ctx context.Context, an *AdminNotify) *NotifyManager {
@@ -27,6 +32,8 @@ func NewNotifyManager(ctx context.Context, an *AdminNotify) *NotifyManager {
 		webhook: an.Webhook,
 		slack:   an.Slack,
 		C:       make(chan string, MaxNotifyBuffer),
+
+		subscribers: make(map[chan string]struct{}),
 	}
 
 	go nm.run()
@@ -42,6 +49,7 @@ func (nm *NotifyManager) run() {
 
 		case m := <-nm.C:
 			log.Printf("[NotifyManager] msg=%s\n", m)
+			nm.publish(m)
 			if nm.webhook != "" {
 				cl := &http.Client{Timeout: 500 * time.Millisecond}
 				res, err := cl.Post(nm.webhook, "application/json", bytes.NewBufferString(m))
@@ -59,3 +67,32 @@ func (nm *NotifyManager) run() {
 		}
 	}
 }
+
+// Subscribe returns a channel receiving every notification until the
+// returned cancel function is called. Slow subscribers miss messages
+// rather than blocking the notifier.
+func (nm *NotifyManager) Subscribe() (chan string, func()) {
+	ch := make(chan string, MaxSubscriberBuffer)
+
+	nm.Lock()
+	nm.subscribers[ch] = struct{}{}
+	nm.Unlock()
+
+	return ch, func() {
+		nm.Lock()
+		delete(nm.subscribers, ch)
+		nm.Unlock()
+	}
+}
+
+func (nm *NotifyManager) publish(m string) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	for ch := range nm.subscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
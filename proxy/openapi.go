@@ -0,0 +1,233 @@
+package proxy
+
+// OpenAPIDocument describes the v1 admin API. Paths are relative to the
+// configured admin path (e.g. /_admin).
+const OpenAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Buffy admin API",
+    "version": "v1"
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": { "type": "http", "scheme": "bearer" },
+      "basic": { "type": "http", "scheme": "basic" }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {
+          "status": { "type": "string", "example": "error" },
+          "code": { "type": "integer" },
+          "error": { "type": "string" }
+        }
+      },
+      "GateRequest": {
+        "type": "object",
+        "required": ["action"],
+        "properties": {
+          "action": { "type": "string", "enum": ["open", "close"] },
+          "reason": { "type": "string" },
+          "ttl": { "type": "string", "example": "30m", "description": "revert to the previous state after this duration" }
+        }
+      },
+      "GateChange": {
+        "type": "object",
+        "properties": {
+          "state": { "type": "string", "enum": ["opened", "closed"] },
+          "actor": { "type": "string", "example": "admin:ci", "description": "system, admin[:name], schedule:<id>, breaker or ttl" },
+          "reason": { "type": "string" },
+          "changed_at": { "type": "string", "format": "date-time" },
+          "expires_at": { "type": "string", "format": "date-time" },
+          "version": { "type": "integer", "format": "int64", "description": "time of the change in nanoseconds, used to merge cluster replicas" },
+          "node": { "type": "string", "description": "cluster node that made the change" }
+        }
+      },
+      "Gate": {
+        "type": "object",
+        "properties": {
+          "upstream": { "type": "string" },
+          "gate": { "type": "string", "enum": ["opened", "closed"] },
+          "change": { "$ref": "#/components/schemas/GateChange" }
+        }
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "error",
+        "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Error" } } }
+      }
+    }
+  },
+  "security": [{ "bearer": [] }, { "basic": [] }],
+  "paths": {
+    "/v1/openapi.json": {
+      "get": { "summary": "This document", "responses": { "200": { "description": "OpenAPI document" } } }
+    },
+    "/v1/config": {
+      "get": { "summary": "Loaded configuration", "responses": { "200": { "description": "configuration" }, "401": { "$ref": "#/components/responses/Error" } } }
+    },
+    "/v1/status": {
+      "get": { "summary": "Server, upstream and endpoint state", "responses": { "200": { "description": "status" }, "401": { "$ref": "#/components/responses/Error" } } }
+    },
+    "/v1/metrics": {
+      "get": { "summary": "Prometheus metrics (also served on /metrics)", "responses": { "200": { "description": "text exposition format" } } }
+    },
+    "/v1/upstreams": {
+      "get": { "summary": "List upstreams", "responses": { "200": { "description": "upstreams" } } },
+      "post": {
+        "summary": "Add an upstream",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object", "description": "same fields as an upstream in the YAML config" } } } },
+        "responses": { "201": { "description": "created" }, "400": { "$ref": "#/components/responses/Error" }, "409": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/upstreams/{id}": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": { "summary": "Get an upstream", "responses": { "200": { "description": "upstream" }, "404": { "$ref": "#/components/responses/Error" } } },
+      "put": {
+        "summary": "Replace an upstream, keeping its gate state",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object" } } } },
+        "responses": { "200": { "description": "updated" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      },
+      "delete": {
+        "summary": "Delete an upstream that no endpoint uses",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "responses": { "200": { "description": "deleted" }, "404": { "$ref": "#/components/responses/Error" }, "409": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/upstreams/{id}/gate": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": {
+        "summary": "Get the gate state",
+        "responses": {
+          "200": { "description": "gate", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Gate" } } } },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "Open or close the gate",
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/GateRequest" } } } },
+        "responses": {
+          "200": { "description": "gate", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Gate" } } } },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "put": {
+        "summary": "Open or close the gate",
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "$ref": "#/components/schemas/GateRequest" } } } },
+        "responses": {
+          "200": { "description": "gate", "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Gate" } } } },
+          "400": { "$ref": "#/components/responses/Error" },
+          "403": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/v1/endpoints": {
+      "get": { "summary": "List endpoints", "responses": { "200": { "description": "endpoints" } } },
+      "post": {
+        "summary": "Add an endpoint",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object", "description": "same fields as an endpoint in the YAML config" } } } },
+        "responses": { "201": { "description": "created" }, "400": { "$ref": "#/components/responses/Error" }, "409": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/endpoints/{id}": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": { "summary": "Get an endpoint", "responses": { "200": { "description": "endpoint" }, "404": { "$ref": "#/components/responses/Error" } } },
+      "put": {
+        "summary": "Replace an endpoint",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object" } } } },
+        "responses": { "200": { "description": "updated" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      },
+      "delete": {
+        "summary": "Delete an endpoint",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "responses": { "200": { "description": "deleted" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/endpoints/{id}/cache": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": { "summary": "List the cached responses of an endpoint", "responses": { "200": { "description": "cache entries" }, "404": { "$ref": "#/components/responses/Error" } } },
+      "delete": {
+        "summary": "Purge the cached responses of an endpoint",
+        "parameters": [{ "name": "prefix", "in": "query", "required": false, "schema": { "type": "string" }, "description": "only the URLs starting with it" }],
+        "responses": { "200": { "description": "number of purged entries" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/endpoints/{id}/rate_limit": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": { "summary": "Get the rate limit of an endpoint and the number of clients tracked", "responses": { "200": { "description": "rate limit" }, "404": { "$ref": "#/components/responses/Error" } } },
+      "put": {
+        "summary": "Change the rate limit of an endpoint, keeping its clients' buckets (rate 0 lifts it)",
+        "parameters": [{ "name": "persist", "in": "query", "required": false, "schema": { "type": "boolean" }, "description": "save the change to the config file (defaults to admin.persist)" }],
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object" } } } },
+        "responses": { "200": { "description": "updated" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/queue/{id}": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "get": { "summary": "List the requests waiting in the queue of an endpoint", "responses": { "200": { "description": "waiting requests, in release order" }, "404": { "$ref": "#/components/responses/Error" } } }
+    },
+    "/v1/queue/{id}/flush": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "post": {
+        "summary": "Answer every waiting request of an endpoint with a response",
+        "requestBody": { "required": false, "content": { "application/json": { "schema": { "type": "object", "properties": { "response": { "type": "string", "description": "named response, defaults to flushed" } } } } } },
+        "responses": { "200": { "description": "number of flushed requests" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/queue/{id}/{request}": {
+      "parameters": [
+        { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } },
+        { "name": "request", "in": "path", "required": true, "schema": { "type": "string" }, "description": "request id" }
+      ],
+      "delete": {
+        "summary": "Answer one waiting request with a response",
+        "parameters": [{ "name": "response", "in": "query", "required": false, "schema": { "type": "string" }, "description": "named response, defaults to flushed" }],
+        "responses": { "200": { "description": "canceled" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/queue/{id}/{request}/release": {
+      "parameters": [
+        { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } },
+        { "name": "request", "in": "path", "required": true, "schema": { "type": "string" }, "description": "request id" }
+      ],
+      "post": {
+        "summary": "Send one waiting request to an upstream of the endpoint right away, whatever its gate",
+        "requestBody": { "required": false, "content": { "application/json": { "schema": { "type": "object", "properties": { "upstream": { "type": "string", "description": "defaults to the first upstream" } } } } } },
+        "responses": { "200": { "description": "released" }, "400": { "$ref": "#/components/responses/Error" }, "404": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/upstreams/{id}/drain": {
+      "parameters": [{ "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }],
+      "post": { "summary": "Close the gate and report the requests still in flight", "responses": { "200": { "description": "gate closed" }, "404": { "$ref": "#/components/responses/Error" } } }
+    },
+    "/v1/reload": {
+      "post": { "summary": "Reload upstreams and endpoints from the config file", "responses": { "200": { "description": "reloaded" }, "400": { "$ref": "#/components/responses/Error" } } }
+    },
+    "/v1/events": {
+      "get": { "summary": "Stream notifications as server-sent events", "responses": { "200": { "description": "text/event-stream" } } }
+    },
+    "/v1/cluster": {
+      "get": { "summary": "Cluster node, peers and config version", "responses": { "200": { "description": "cluster status" } } }
+    },
+    "/v1/cluster/sync": {
+      "post": {
+        "summary": "Merge the state of a peer and answer with the local state",
+        "description": "Authenticated with the cluster token when one is configured.",
+        "requestBody": { "required": true, "content": { "application/json": { "schema": { "type": "object" } } } },
+        "responses": { "200": { "description": "local state" }, "400": { "$ref": "#/components/responses/Error" } }
+      }
+    },
+    "/v1/config/persist": {
+      "post": { "summary": "Save the current upstreams and endpoints to the config file", "responses": { "200": { "description": "saved" }, "500": { "$ref": "#/components/responses/Error" } } }
+    }
+  }
+}
+`
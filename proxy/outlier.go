@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutlierInterval      = 10 * time.Second
+	DefaultOutlierEjectionTime  = 30 * time.Second
+	DefaultOutlierMinRequests   = 5
+	DefaultOutlierMaxEjectedPct = 50
+)
+
+// OutlierDef ejects an upstream of an endpoint with several of them for
+// `ejection_time`, judged on the requests proxied to it: after
+// `consecutive_5xx` failed requests (error or 5xx), or when its mean
+// latency over `interval` exceeds `latency_factor` times the median of the
+// upstreams with at least `min_requests`. At most `max_ejected_percent` of
+// the upstreams are ejected at once, and never all of them.
+type OutlierDef struct {
+	Consecutive5xx    int      `json:"consecutive_5xx"     yaml:"consecutive_5xx"`
+	LatencyFactor     float64  `json:"latency_factor"      yaml:"latency_factor"`
+	MinRequests       int      `json:"min_requests"        yaml:"min_requests"`
+	Interval          Duration `json:"interval"            yaml:"interval"`
+	EjectionTime      Duration `json:"ejection_time"       yaml:"ejection_time"`
+	MaxEjectedPercent int      `json:"max_ejected_percent" yaml:"max_ejected_percent"`
+}
+
+func (od *OutlierDef) Validate() error {
+	if od.Consecutive5xx < 0 || od.MinRequests < 0 || od.Interval < 0 || od.EjectionTime < 0 {
+		return fmt.Errorf("outlier: consecutive_5xx, min_requests, interval and ejection_time must not be negative")
+	}
+	if od.LatencyFactor != 0 && od.LatencyFactor <= 1 {
+		return fmt.Errorf("outlier: latency_factor must be greater than 1: %v", od.LatencyFactor)
+	}
+	if od.MaxEjectedPercent < 0 || od.MaxEjectedPercent > 100 {
+		return fmt.Errorf("outlier: max_ejected_percent must be between 0 and 100: %d", od.MaxEjectedPercent)
+	}
+	return nil
+}
+
+func (od *OutlierDef) enabled() bool {
+	return od.Consecutive5xx > 0 || od.LatencyFactor > 0
+}
+
+type memberStats struct {
+	id string
+
+	consecutive int
+	requests    int
+	failures    int
+	latency     time.Duration
+	mean        time.Duration
+
+	ejectedUntil time.Time
+	reason       string
+	ejections    int
+}
+
+type outlierDetector struct {
+	def         *OutlierDef
+	endpoint    string
+	interval    time.Duration
+	ejection    time.Duration
+	minRequests int
+	maxEjected  int
+
+	members   []*memberStats
+	evaluated time.Time
+
+	notify  func(string)
+	metrics *Metrics
+
+	sync.Mutex
+}
+
+func newOutlierDetector(def *EndpointDef, members []*Upstream, notify func(string), metrics *Metrics) *outlierDetector {
+	od := &def.Outlier
+
+	o := &outlierDetector{
+		def:         od,
+		endpoint:    def.Id,
+		interval:    time.Duration(od.Interval),
+		ejection:    time.Duration(od.EjectionTime),
+		minRequests: od.MinRequests,
+		evaluated:   time.Now(),
+		notify:      notify,
+		metrics:     metrics,
+	}
+	if o.interval == 0 {
+		o.interval = DefaultOutlierInterval
+	}
+	if o.ejection == 0 {
+		o.ejection = DefaultOutlierEjectionTime
+	}
+	if o.minRequests == 0 {
+		o.minRequests = DefaultOutlierMinRequests
+	}
+
+	pct := od.MaxEjectedPercent
+	if pct == 0 {
+		pct = DefaultOutlierMaxEjectedPct
+	}
+	o.maxEjected = len(members) * pct / 100
+	if o.maxEjected >= len(members) {
+		o.maxEjected = len(members) - 1
+	}
+
+	for _, m := range members {
+		o.members = append(o.members, &memberStats{id: m.Id})
+	}
+	return o
+}
+
+func (o *outlierDetector) member(id string) *memberStats {
+	for _, m := range o.members {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// ejected reports whether an upstream is ejected at now, and until when.
+func (o *outlierDetector) ejected(id string, now time.Time) (time.Time, bool) {
+	if o == nil {
+		return time.Time{}, false
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	m := o.member(id)
+	if m == nil || !now.Before(m.ejectedUntil) {
+		return time.Time{}, false
+	}
+	return m.ejectedUntil, true
+}
+
+// observe feeds the detector with a request proxied to an upstream.
+func (o *outlierDetector) observe(id string, failed bool, latency time.Duration, now time.Time) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	m := o.member(id)
+	if m == nil {
+		return
+	}
+
+	m.requests++
+	m.latency += latency
+	if failed {
+		m.failures++
+		m.consecutive++
+	} else {
+		m.consecutive = 0
+	}
+
+	if o.def.Consecutive5xx > 0 && m.consecutive >= o.def.Consecutive5xx {
+		o.eject(m, fmt.Sprintf("%d consecutive failures", m.consecutive), now)
+	}
+
+	if now.Sub(o.evaluated) >= o.interval {
+		o.evaluate(now)
+	}
+}
+
+// evaluate ejects the upstreams much slower than the others over the last
+// interval, and starts a new one.
+func (o *outlierDetector) evaluate(now time.Time) {
+	o.evaluated = now
+
+	var means []time.Duration
+	for _, m := range o.members {
+		m.mean = 0
+		if m.requests >= o.minRequests {
+			m.mean = m.latency / time.Duration(m.requests)
+			means = append(means, m.mean)
+		}
+	}
+
+	if o.def.LatencyFactor > 0 && len(means) >= 2 {
+		sort.Slice(means, func(i, j int) bool { return means[i] < means[j] })
+		median := means[len(means)/2]
+		if len(means)%2 == 0 {
+			median = (means[len(means)/2-1] + median) / 2
+		}
+
+		limit := time.Duration(float64(median) * o.def.LatencyFactor)
+		for _, m := range o.members {
+			if m.mean > limit {
+				o.eject(m, fmt.Sprintf("mean latency %s over %s (median %s)", m.mean, limit, median), now)
+			}
+		}
+	}
+
+	for _, m := range o.members {
+		m.requests, m.failures, m.latency = 0, 0, 0
+	}
+}
+
+// eject takes an upstream out of the rotation unless too many are ejected
+// already. The caller must hold the lock.
+func (o *outlierDetector) eject(m *memberStats, reason string, now time.Time) {
+	if now.Before(m.ejectedUntil) {
+		return
+	}
+
+	ejected := 0
+	for _, other := range o.members {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if ejected >= o.maxEjected {
+		return
+	}
+
+	m.ejectedUntil = now.Add(o.ejection)
+	m.reason = reason
+	m.ejections++
+	m.consecutive = 0
+
+	log.Printf("[outlier:%s] upstream %s ejected until %s: %s\n", o.endpoint, m.id, m.ejectedUntil.Format(time.RFC3339), reason)
+
+	o.metrics.Inc(MetricOutlierEjectionsTotal, o.endpoint, m.id)
+
+	bs, _ := json.Marshal(map[string]interface{}{
+		"status":   "outlier",
+		"endpoint": o.endpoint,
+		"upstream": m.id,
+		"reason":   reason,
+		"until":    m.ejectedUntil,
+	})
+	o.notify(string(bs))
+}
+
+// MemberInfo reports an upstream of an endpoint.
+type MemberInfo struct {
+	Id           string     `json:"id"`
+	Ejected      bool       `json:"ejected"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	Ejections    int        `json:"ejections"`
+	Consecutive  int        `json:"consecutive_failures"`
+	Latency      float64    `json:"latency"`
+}
+
+// Members reports the upstreams of the queue with their ejection state.
+func (q *EndpointQueue) Members() []MemberInfo {
+	if q == nil {
+		return nil
+	}
+
+	var infos []MemberInfo
+	for _, m := range q.members {
+		infos = append(infos, q.outlier.info(m.Id, time.Now()))
+	}
+	return infos
+}
+
+func (o *outlierDetector) info(id string, now time.Time) MemberInfo {
+	if o == nil {
+		return MemberInfo{Id: id}
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	m := o.member(id)
+	info := MemberInfo{
+		Id:          id,
+		Ejections:   m.ejections,
+		Consecutive: m.consecutive,
+		Latency:     m.mean.Seconds(),
+	}
+	if now.Before(m.ejectedUntil) {
+		until := m.ejectedUntil
+		info.Ejected = true
+		info.EjectedUntil = &until
+		info.Reason = m.reason
+	}
+	return info
+}
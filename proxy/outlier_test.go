@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMembers(ids ...string) []*Upstream {
+	var members []*Upstream
+	for _, id := range ids {
+		members = append(members, &Upstream{
+			Id:      id,
+			Def:     &UpstreamDef{Id: id},
+			Handler: &UpstreamHandler{GateState: GateOpened, UpstreamStatus: StatusAvailable},
+		})
+	}
+	return members
+}
+
+func TestOutlierEjection(t *testing.T) {
+	members := newTestMembers("a", "b", "c")
+	def := &EndpointDef{
+		Id:      "ep",
+		Timeout: Duration(time.Second),
+		Outlier: OutlierDef{Consecutive5xx: 3, LatencyFactor: 3, MinRequests: 2, EjectionTime: Duration(time.Minute)},
+	}
+
+	q, err := NewEndpointQueue(def, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	q.outlier = newOutlierDetector(def, members, func(msg string) { notified = append(notified, msg) }, nil)
+	o := q.outlier
+
+	// round robin over the members
+	now := time.Now()
+	for _, want := range []string{"a", "b", "c", "a"} {
+		if m, _ := q.pick(now); m == nil || m.Id != want {
+			t.Fatalf("picked %v, want %s", m, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		o.observe("b", true, time.Millisecond, now)
+	}
+	if _, ok := o.ejected("b", now); !ok {
+		t.Fatal("b not ejected after 3 failures")
+	}
+	for _, want := range []string{"c", "a", "c"} {
+		if m, _ := q.pick(now); m.Id != want {
+			t.Fatalf("picked %s, want %s", m.Id, want)
+		}
+	}
+
+	// at most half of the members: a slow c stays in
+	o.evaluated = now
+	for i := 0; i < 2; i++ {
+		o.observe("a", false, 10*time.Millisecond, now)
+		o.observe("c", false, time.Second, now)
+	}
+	o.evaluate(now)
+	if _, ok := o.ejected("c", now); ok {
+		t.Error("ejected more than max_ejected_percent")
+	}
+
+	// once b is back, c is ejected as much slower than the median
+	later := now.Add(2 * time.Minute)
+	if _, ok := o.ejected("b", later); ok {
+		t.Fatal("b still ejected after ejection_time")
+	}
+	o.evaluated = later
+	for i := 0; i < 2; i++ {
+		o.observe("a", false, 10*time.Millisecond, later)
+		o.observe("b", false, 20*time.Millisecond, later)
+		o.observe("c", false, time.Second, later)
+	}
+	o.evaluate(later)
+	if _, ok := o.ejected("c", later); !ok {
+		t.Error("slow c not ejected")
+	}
+
+	infos := q.Members()
+	if len(infos) != 3 || infos[2].Id != "c" || infos[1].Ejections != 1 {
+		t.Errorf("members: %+v", infos)
+	}
+	if len(notified) != 2 {
+		t.Errorf("notified: %v", notified)
+	}
+}
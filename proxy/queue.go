@@ -0,0 +1,782 @@
+package proxy
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultLane = "default"
+
+var (
+	ErrQueueTimeout   = errors.New("timeout while waiting for the upstream")
+	ErrQueueAbandoned = errors.New("client left while waiting for the upstream")
+	ErrNotQueued      = errors.New("not found waiting request id")
+)
+
+// queueFlushed is returned by Wait for a request taken out of the queue
+// through the admin API, with the response to answer it.
+type queueFlushed struct {
+	response string
+}
+
+func (e *queueFlushed) Error() string {
+	return "flushed from the queue: " + e.response
+}
+
+// QueueDef orders the requests an endpoint holds for its upstream. They
+// are released by lane priority, first in first out within a lane, and at
+// most `release_rate` per second (0: as fast as the upstream allows).
+type QueueDef struct {
+	ReleaseRate float64   `json:"release_rate" yaml:"release_rate"`
+	Lanes       []LaneDef `json:"lanes"        yaml:"lanes"`
+}
+
+// LaneDef selects requests by header, path prefix or client address. Every
+// condition given must match; the first matching lane wins. Requests
+// matching no lane go to the "default" lane with priority 0.
+type LaneDef struct {
+	Id       string   `json:"id"       yaml:"id"`
+	Priority int      `json:"priority" yaml:"priority"`
+	Header   string   `json:"header"   yaml:"header"`
+	Values   []string `json:"values"   yaml:"values"`
+	Path     string   `json:"path"     yaml:"path"`
+	Clients  []string `json:"clients"  yaml:"clients"`
+}
+
+type lane struct {
+	def  *LaneDef
+	nets []*net.IPNet
+}
+
+func (qd *QueueDef) Validate() error {
+	if qd.ReleaseRate < 0 {
+		return fmt.Errorf("queue: invalid release_rate: %v", qd.ReleaseRate)
+	}
+
+	ids := make(map[string]bool)
+	for i := range qd.Lanes {
+		ld := &qd.Lanes[i]
+		if _, err := newLane(ld); err != nil {
+			return err
+		}
+		if ids[ld.Id] {
+			return fmt.Errorf("queue: duplicated lane id: %s", ld.Id)
+		}
+		ids[ld.Id] = true
+	}
+
+	return nil
+}
+
+func newLane(ld *LaneDef) (*lane, error) {
+	if ld.Id == "" {
+		return nil, fmt.Errorf("lane: missing 'id'")
+	}
+	if ld.Id == DefaultLane {
+		return nil, fmt.Errorf("lane %s: reserved id", ld.Id)
+	}
+	if ld.Header == "" && ld.Path == "" && len(ld.Clients) == 0 {
+		return nil, fmt.Errorf("lane %s: requires 'header', 'path' or 'clients'", ld.Id)
+	}
+
+	l := &lane{def: ld}
+	for _, s := range ld.Clients {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("lane %s: invalid client: %s", ld.Id, err)
+		}
+		l.nets = append(l.nets, n)
+	}
+
+	return l, nil
+}
+
+func (l *lane) match(r *http.Request) bool {
+	if l.def.Header != "" {
+		v, ok := r.Header[http.CanonicalHeaderKey(l.def.Header)]
+		if !ok {
+			return false
+		}
+		if len(l.def.Values) > 0 && !containsAny(l.def.Values, v) {
+			return false
+		}
+	}
+
+	if l.def.Path != "" && !strings.HasPrefix(r.URL.Path, l.def.Path) {
+		return false
+	}
+
+	if len(l.nets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAny(want, got []string) bool {
+	for _, w := range want {
+		for _, g := range got {
+			if w == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queueTicket is a request waiting in the queue. ready is closed when it
+// is released.
+type queueTicket struct {
+	lane     string
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+
+	// the upstream that took the request on release
+	member *Upstream
+
+	// the response to a request flushed instead
+	response string
+
+	// the queue holding the ticket, and the ticket replacing it when
+	// moved to the queue of an endpoint updated at runtime
+	queue *EndpointQueue
+	moved *queueTicket
+
+	// the id of the request, unique in the endpoint
+	id     string
+	req    *http.Request
+	queued time.Time
+}
+
+// outcome returns the upstream a ticket was released to, or the error of a
+// flushed one.
+func (t *queueTicket) outcome() (*Upstream, error) {
+	if t.member == nil {
+		return nil, &queueFlushed{response: t.response}
+	}
+	return t.member, nil
+}
+
+type ticketHeap []*queueTicket
+
+func (h ticketHeap) Len() int { return len(h) }
+
+func (h ticketHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h ticketHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ticketHeap) Push(x interface{}) {
+	t := x.(*queueTicket)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *ticketHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
+
+// EndpointQueue holds the requests of an endpoint until one of its
+// upstreams can take them, in turn. A dispatcher goroutine runs only while
+// requests are waiting.
+type EndpointQueue struct {
+	endpoint string
+	members  []*Upstream
+	outlier  *outlierDetector
+	inflight *inflightLimit
+	global   *inflightLimit
+	lanes    []*lane
+	rate     float64
+	timeout  time.Duration
+
+	// the queue replacing this one at runtime
+	successor *EndpointQueue
+
+	// the response to the requests of an endpoint deleted at runtime
+	closed string
+
+	waiting ticketHeap
+	seq     uint64
+	depth   map[string]int
+	next    time.Time
+	turn    int
+	running bool
+
+	// wakes the dispatcher when a request leaves on its own
+	wakeC chan struct{}
+
+	sync.Mutex
+}
+
+func NewEndpointQueue(def *EndpointDef, members []*Upstream) (*EndpointQueue, error) {
+	if len(members) == 0 {
+		return nil, errors.New("queue: no upstream")
+	}
+
+	q := &EndpointQueue{
+		endpoint: def.Id,
+		members:  members,
+		inflight: newInflightLimit(def.MaxInflight),
+		rate:     def.Queue.ReleaseRate,
+		timeout:  def.QueueTimeout(),
+		depth:    make(map[string]int),
+		wakeC:    make(chan struct{}, 1),
+	}
+
+	for i := range def.Queue.Lanes {
+		l, err := newLane(&def.Queue.Lanes[i])
+		if err != nil {
+			return nil, err
+		}
+		q.lanes = append(q.lanes, l)
+	}
+
+	return q, nil
+}
+
+// classify returns the lane of a request and its priority.
+func (q *EndpointQueue) classify(r *http.Request) (string, int) {
+	for _, l := range q.lanes {
+		if l.match(r) {
+			return l.def.Id, l.def.Priority
+		}
+	}
+	return DefaultLane, 0
+}
+
+// Wait blocks until the request is released, the deadline passes, if not
+// zero, or the request context is done. It returns the lane of the request and the
+// upstream it was released to, or ErrQueueTimeout, ErrQueueAbandoned or a
+// *queueFlushed error. A released request holds an in-flight slot, freed
+// by done.
+func (q *EndpointQueue) Wait(r *http.Request, deadline time.Time) (string, *Upstream, error) {
+	laneId, priority := q.classify(r)
+	if !before(time.Now(), deadline) {
+		return laneId, nil, ErrQueueTimeout
+	}
+
+	t := q.push(r, laneId, priority)
+
+	// a zero deadline is none
+	var timeoutC <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	for {
+		select {
+		case <-t.ready:
+			// moved to the queue replacing this one
+			if t.moved != nil {
+				t = t.moved
+				continue
+			}
+			member, err := t.outcome()
+			return t.lane, member, err
+		case <-timeoutC:
+			laneId = t.lane
+			// released in the meantime
+			if t = t.leave(); t != nil {
+				member, err := t.outcome()
+				return t.lane, member, err
+			}
+			return laneId, nil, ErrQueueTimeout
+		case <-r.Context().Done():
+			laneId = t.lane
+			if t = t.leave(); t != nil && t.member != nil {
+				t.queue.done(t.member)
+			}
+			// the `total` timeout of the endpoint
+			if r.Context().Err() == context.DeadlineExceeded {
+				return laneId, nil, ErrQueueTimeout
+			}
+			return laneId, nil, ErrQueueAbandoned
+		}
+	}
+}
+
+// push queues a request, or passes it on to the queue replacing this one.
+func (q *EndpointQueue) push(r *http.Request, laneId string, priority int) *queueTicket {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.successor != nil {
+		if r != nil {
+			laneId, priority = q.successor.classify(r)
+		}
+		return q.successor.push(r, laneId, priority)
+	}
+
+	// flushed right away
+	if q.closed != "" {
+		t := &queueTicket{lane: laneId, priority: priority, index: -1, ready: make(chan struct{}), queue: q, response: q.closed}
+		close(t.ready)
+		return t
+	}
+
+	id := ""
+	if r != nil {
+		// set by In
+		id = r.Header.Get(HeaderRequestID)
+	}
+	return q.enqueue(r, id, laneId, priority, time.Now())
+}
+
+// enqueue adds a request to the waiting ones. The caller must hold the
+// lock.
+func (q *EndpointQueue) enqueue(r *http.Request, id, laneId string, priority int, queued time.Time) *queueTicket {
+	q.seq++
+	t := &queueTicket{
+		lane:     laneId,
+		priority: priority,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+		queue:    q,
+		id:       id,
+		req:      r,
+		queued:   queued,
+	}
+
+	heap.Push(&q.waiting, t)
+	q.depth[laneId]++
+
+	// nobody ahead: released right away when the upstream can take it
+	q.release(time.Now())
+
+	if q.waiting.Len() > 0 && !q.running {
+		q.running = true
+		go q.dispatch()
+	}
+
+	return t
+}
+
+// handOver moves the waiting requests, in order, to the queue replacing
+// this one when the endpoint is updated at runtime, and passes on those
+// still to come. Requests in flight free their slot there too.
+func (q *EndpointQueue) handOver(next *EndpointQueue) {
+	q.Lock()
+	defer q.Unlock()
+	next.Lock()
+	defer next.Unlock()
+
+	q.successor = next
+	next.inflight.carry(q.inflight)
+
+	for q.waiting.Len() > 0 {
+		t := heap.Pop(&q.waiting).(*queueTicket)
+		q.depth[t.lane]--
+
+		laneId, priority := t.lane, t.priority
+		if t.req != nil {
+			laneId, priority = next.classify(t.req)
+		}
+		t.moved = next.enqueue(t.req, t.id, laneId, priority, t.queued)
+		close(t.ready)
+	}
+
+	// the dispatcher has nothing left to wait for
+	select {
+	case q.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// current returns the queue replacing this one at runtime, or itself.
+func (q *EndpointQueue) current() *EndpointQueue {
+	q.Lock()
+	next := q.successor
+	q.Unlock()
+
+	if next == nil {
+		return q
+	}
+	return next.current()
+}
+
+// leave takes a ticket out of its queue, following its moves. It returns
+// nil, or the ticket released or flushed in the meantime.
+func (t *queueTicket) leave() *queueTicket {
+	for !t.queue.remove(t) {
+		if t.moved == nil {
+			return t
+		}
+		t = t.moved
+	}
+	return nil
+}
+
+// remove takes a ticket out of the queue. It returns false if the ticket
+// was released already.
+func (q *EndpointQueue) remove(t *queueTicket) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+
+	heap.Remove(&q.waiting, t.index)
+	q.depth[t.lane]--
+
+	select {
+	case q.wakeC <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// release lets requests go, highest priority first, while the release rate
+// allows and an upstream admits them. A released request holds an
+// in-flight slot of its upstream. It returns how long to wait before trying
+// again, or 0 to wait for a change of the upstreams. The caller must hold
+// the lock.
+func (q *EndpointQueue) release(now time.Time) time.Duration {
+	for q.waiting.Len() > 0 {
+		if q.rate > 0 && now.Before(q.next) {
+			return q.next.Sub(now)
+		}
+
+		member, wait := q.pick(now)
+		if member == nil {
+			return wait
+		}
+
+		if q.rate > 0 {
+			if q.next.Before(now) {
+				q.next = now
+			}
+			q.next = q.next.Add(time.Duration(float64(time.Second) / q.rate))
+		}
+
+		t := heap.Pop(&q.waiting).(*queueTicket)
+		t.member = member
+		q.depth[t.lane]--
+		close(t.ready)
+	}
+
+	return 0
+}
+
+// pick returns the next upstream in turn that admits a request, skipping
+// ejected outliers, or how long to wait as release does. The request also
+// counts against the in-flight limits of the endpoint and the server.
+func (q *EndpointQueue) pick(now time.Time) (*Upstream, time.Duration) {
+	var wait time.Duration
+
+	if q.inflight.full() || q.global.full() {
+		return nil, 0
+	}
+
+	n := len(q.members)
+	for i := 0; i < n; i++ {
+		m := q.members[(q.turn+i)%n]
+
+		if until, ok := q.outlier.ejected(m.Id, now); ok {
+			wait = minWait(wait, until.Sub(now))
+			continue
+		}
+
+		ok, w := m.Handler.admit(now)
+		if ok {
+			// another queue took the last slot of the server meanwhile
+			q.inflight.take()
+			if !q.global.take() {
+				q.inflight.done()
+				m.Handler.done()
+				return nil, 0
+			}
+			q.turn = (q.turn + i + 1) % n
+			return m, 0
+		}
+		wait = minWait(wait, w)
+	}
+
+	return nil, wait
+}
+
+// done frees the in-flight slot of a request released to member, counted
+// by the queue replacing this one if any.
+func (q *EndpointQueue) done(member *Upstream) {
+	member.Handler.done()
+	q.current().inflight.done()
+	q.global.done()
+}
+
+// Len returns the number of waiting requests.
+func (q *EndpointQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.waiting.Len()
+}
+
+// minWait returns the shortest of two waits, where 0 is no wait at all.
+func minWait(a, b time.Duration) time.Duration {
+	if a == 0 || b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// gateOpened reports whether the gate of any upstream is open.
+func (q *EndpointQueue) gateOpened() bool {
+	for _, m := range q.members {
+		if m.Handler.GetGateState() == GateOpened {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch releases waiting requests as soon as an upstream changes, an
+// in-flight slot is freed or the rate allows, without polling.
+func (q *EndpointQueue) dispatch() {
+	cases := make([]reflect.SelectCase, len(q.members)+4)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.wakeC)}
+
+	for {
+		// watch before looking so that no change is missed
+		cases[2] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.inflight.watch())}
+		cases[3] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.global.watch())}
+		for i, m := range q.members {
+			cases[i+4] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(m.Handler.watch())}
+		}
+
+		q.Lock()
+		wait := q.release(time.Now())
+		if q.waiting.Len() == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		q.Unlock()
+
+		var timer *time.Timer
+		cases[1] = reflect.SelectCase{Dir: reflect.SelectRecv}
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			cases[1].Chan = reflect.ValueOf(timer.C)
+		}
+
+		reflect.Select(cases)
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Depth returns the number of waiting requests per lane.
+func (q *EndpointQueue) Depth() map[string]int {
+	depth := make(map[string]int)
+	if q == nil {
+		return depth
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	depth[DefaultLane] = q.depth[DefaultLane]
+	for _, l := range q.lanes {
+		depth[l.def.Id] = q.depth[l.def.Id]
+	}
+	return depth
+}
+
+// QueuedRequest reports a request waiting in a queue.
+type QueuedRequest struct {
+	Id       string            `json:"id"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Lane     string            `json:"lane"`
+	Client   string            `json:"client"`
+	Headers  map[string]string `json:"headers"`
+	Waiting  float64           `json:"waiting"`
+	Targets  []string          `json:"targets"`
+	Position int               `json:"position"`
+}
+
+// summaryHeaders are not shown with their value.
+var summaryHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// summarize returns the headers of a request with their first value,
+// shortened, without those set by buffy and hiding credentials.
+func summarize(h http.Header) map[string]string {
+	sum := make(map[string]string)
+	for k, v := range h {
+		if strings.HasPrefix(k, "X-Buffy-") || len(v) == 0 {
+			continue
+		}
+		if containsFold(summaryHeaders, k) {
+			sum[k] = "<hidden>"
+			continue
+		}
+		value := v[0]
+		if len(value) > 64 {
+			value = value[:64] + "..."
+		}
+		sum[k] = value
+	}
+	return sum
+}
+
+// Requests reports the waiting requests in the order of their release,
+// with the upstreams that may take them.
+func (q *EndpointQueue) Requests() []QueuedRequest {
+	now := time.Now()
+
+	var targets []string
+	for _, m := range q.members {
+		if _, ok := q.outlier.ejected(m.Id, now); !ok {
+			targets = append(targets, m.Id)
+		}
+	}
+
+	q.Lock()
+	tickets := append(ticketHeap(nil), q.waiting...)
+	q.Unlock()
+
+	sort.Slice(tickets, func(i, j int) bool { return tickets.Less(i, j) })
+
+	reqs := []QueuedRequest{}
+	for i, t := range tickets {
+		qr := QueuedRequest{
+			Lane:     t.lane,
+			Waiting:  now.Sub(t.queued).Seconds(),
+			Targets:  targets,
+			Position: i + 1,
+		}
+		if r := t.req; r != nil {
+			qr.Id = t.id
+			qr.Method = r.Method
+			qr.Path = requestURI(r)
+			qr.Client = r.RemoteAddr
+			qr.Headers = summarize(r.Header)
+		}
+		reqs = append(reqs, qr)
+	}
+	return reqs
+}
+
+// take removes the waiting request with the given id, or every one when
+// id is empty. Ids are unique in the endpoint (see In), so at most one
+// request has a given id. The caller must hold the lock.
+func (q *EndpointQueue) take(id string) []*queueTicket {
+	var taken []*queueTicket
+	for _, t := range append(ticketHeap(nil), q.waiting...) {
+		if id != "" && t.id != id {
+			continue
+		}
+		heap.Remove(&q.waiting, t.index)
+		q.depth[t.lane]--
+		taken = append(taken, t)
+		if id != "" {
+			break
+		}
+	}
+	return taken
+}
+
+// Flush answers the waiting request with the given id, or every one when
+// id is empty, with a named response instead of releasing it. It returns
+// how many were flushed.
+func (q *EndpointQueue) Flush(id, response string) int {
+	q.Lock()
+	defer q.Unlock()
+
+	taken := q.take(id)
+	for _, t := range taken {
+		t.response = response
+		close(t.ready)
+	}
+	return len(taken)
+}
+
+// closeWith flushes the waiting requests of an endpoint deleted at runtime
+// with a named response, as well as those still to come. It returns how
+// many were waiting.
+func (q *EndpointQueue) closeWith(response string) int {
+	q.Lock()
+	q.closed = response
+	q.Unlock()
+
+	return q.Flush("", response)
+}
+
+// ReleaseTo sends the waiting request with the given id to an upstream
+// right away, whatever its gate and limits. It still counts in flight.
+func (q *EndpointQueue) ReleaseTo(id string, member *Upstream) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if id == "" {
+		return ErrNotQueued
+	}
+	taken := q.take(id)
+	if len(taken) == 0 {
+		return ErrNotQueued
+	}
+
+	atomic.AddInt32(&member.Handler.InFlight, 1)
+	q.inflight.force()
+	q.global.force()
+
+	t := taken[0]
+	t.member = member
+	close(t.ready)
+	return nil
+}
@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t testing.TB, qd QueueDef) *EndpointQueue {
+	def := &EndpointDef{Id: "ep", Timeout: Duration(time.Second), Queue: qd}
+	up := &Upstream{
+		Id:      "up",
+		Def:     &UpstreamDef{Id: "up"},
+		Handler: &UpstreamHandler{GateState: GateClosed, UpstreamStatus: StatusAvailable},
+	}
+
+	q, err := NewEndpointQueue(def, []*Upstream{up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func isReleased(tk *queueTicket) bool {
+	select {
+	case <-tk.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestQueueLanes(t *testing.T) {
+	q := newTestQueue(t, QueueDef{
+		ReleaseRate: 1,
+		Lanes: []LaneDef{
+			{Id: "health", Priority: 20, Path: "/health"},
+			{Id: "gold", Priority: 10, Header: "X-Tier", Values: []string{"gold"}},
+			{Id: "office", Priority: 5, Clients: []string{"10.0.0.0/8"}},
+		},
+	})
+
+	for _, tt := range []struct {
+		path, tier, addr, lane string
+	}{
+		{"/health", "", "1.2.3.4:1", "health"},
+		{"/api", "gold", "1.2.3.4:1", "gold"},
+		{"/api", "silver", "10.1.2.3:1", "office"},
+		{"/api", "", "1.2.3.4:1", DefaultLane},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.RemoteAddr = tt.addr
+		if tt.tier != "" {
+			r.Header.Set("X-Tier", tt.tier)
+		}
+		if lane, _ := q.classify(r); lane != tt.lane {
+			t.Errorf("%s %s %s: got lane %s, want %s", tt.path, tt.tier, tt.addr, lane, tt.lane)
+		}
+	}
+
+	// held while the gate is closed, released by priority then in order;
+	// the test releases them itself instead of the dispatcher
+	q.running = true
+	d1 := q.push(nil, DefaultLane, 0)
+	g1 := q.push(nil, "gold", 10)
+	d2 := q.push(nil, DefaultLane, 0)
+	h1 := q.push(nil, "health", 20)
+	g2 := q.push(nil, "gold", 10)
+
+	if depth := q.Depth(); depth["gold"] != 2 || depth[DefaultLane] != 2 || depth["health"] != 1 {
+		t.Errorf("depth: got %v", depth)
+	}
+
+	q.members[0].Handler.UpdateGate(GateOpened)
+
+	now := time.Now()
+	for i, want := range []*queueTicket{h1, g1, g2, d1, d2} {
+		q.Lock()
+		q.release(now.Add(time.Duration(i) * time.Second))
+		q.Unlock()
+
+		if !isReleased(want) {
+			t.Fatalf("step %d: expected %s #%d released", i, want.lane, want.seq)
+		}
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	q := newTestQueue(t, QueueDef{})
+
+	r := httptest.NewRequest("GET", "/api", nil)
+	if _, _, err := q.Wait(r, time.Now().Add(50*time.Millisecond)); err != ErrQueueTimeout {
+		t.Errorf("gate closed: got %v", err)
+	}
+	if depth := q.Depth(); depth[DefaultLane] != 0 {
+		t.Errorf("timed out request still queued: %v", depth)
+	}
+
+	// the client leaves
+	ctx, cancel := context.WithCancel(r.Context())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := q.Wait(r.WithContext(ctx), time.Now().Add(time.Minute)); err != ErrQueueAbandoned {
+		t.Errorf("client left: got %v", err)
+	}
+	if depth := q.Depth(); depth[DefaultLane] != 0 {
+		t.Errorf("abandoned request still queued: %v", depth)
+	}
+
+	q.members[0].Handler.UpdateGate(GateOpened)
+	if _, _, err := q.Wait(r, time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Errorf("gate opened: got %v", err)
+	}
+}
+
+// BenchmarkQueueWakeup holds thousands of requests behind a closed gate and
+// measures how long it takes to release all of them once it opens. Held
+// requests block on channels, so they cost no CPU while waiting.
+func BenchmarkQueueWakeup(b *testing.B) {
+	const held = 5000
+
+	r := httptest.NewRequest("GET", "/api", nil)
+
+	var total time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		q := newTestQueue(b, QueueDef{})
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var last time.Time
+		for j := 0; j < held; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, err := q.Wait(r, time.Now().Add(time.Minute)); err != nil {
+					b.Error(err)
+				}
+				mu.Lock()
+				last = time.Now()
+				mu.Unlock()
+			}()
+		}
+		for q.Depth()[DefaultLane] < held {
+			time.Sleep(time.Millisecond)
+		}
+		b.StartTimer()
+
+		opened := time.Now()
+		q.members[0].Handler.UpdateGate(GateOpened)
+		wg.Wait()
+
+		total += last.Sub(opened)
+	}
+
+	b.ReportMetric(float64(total.Microseconds())/float64(b.N)/1000, "ms-to-release-all")
+}
+
+func TestQueueAdmin(t *testing.T) {
+	ps, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}, EndpointDef{Timeout: Duration(10 * time.Second)})
+	ar, err := ps.newAdminRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := ps.lookupEndpoint("held").Handler.queue
+
+	// held behind the closed gate, in order
+	answers := make(map[string]chan *httptest.ResponseRecorder)
+	for _, id := range []string{"a", "b", "c"} {
+		c := make(chan *httptest.ResponseRecorder, 1)
+		answers[id] = c
+		r := httptest.NewRequest(http.MethodGet, "/held?n="+id, nil)
+		r.Header.Set("X-Request-ID", id)
+		r.Header.Set("Authorization", "secret")
+		go func() {
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, r)
+			c <- w
+		}()
+		for n := q.Len(); q.Len() == n; {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	w := doAdmin(ar, http.MethodGet, "/_admin/v1/queue/held", "")
+	var list struct {
+		Requests []QueuedRequest `json:"requests"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Requests) != 3 || list.Requests[0].Id != "a" || list.Requests[2].Path != "/held?n=c" ||
+		list.Requests[1].Headers["Authorization"] != "<hidden>" || list.Requests[0].Targets[0] != "held" {
+		t.Fatalf("list: got %s", w.Body)
+	}
+
+	if w := doAdmin(ar, http.MethodDelete, "/_admin/v1/queue/held/a?response=gate_closed", ""); w.Code != http.StatusOK {
+		t.Errorf("cancel: got %d %s", w.Code, w.Body)
+	}
+	if w := <-answers["a"]; w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "gate closed") {
+		t.Errorf("canceled: got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := doAdmin(ar, http.MethodPost, "/_admin/v1/queue/held/b/release", `{"upstream": "held"}`); w.Code != http.StatusOK {
+		t.Errorf("release: got %d %s", w.Code, w.Body)
+	}
+	if w := <-answers["b"]; w.Code != http.StatusOK || w.Body.String() != "upstream" {
+		t.Errorf("released: got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := doAdmin(ar, http.MethodPost, "/_admin/v1/queue/held/flush", `{}`); !strings.Contains(w.Body.String(), `"flushed":1`) {
+		t.Errorf("flush: got %d %s", w.Code, w.Body)
+	}
+	if w := <-answers["c"]; w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "flushed") {
+		t.Errorf("flushed: got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := doAdmin(ar, http.MethodDelete, "/_admin/v1/queue/held/c", ""); w.Code != http.StatusNotFound {
+		t.Errorf("cancel of a gone request: got %d", w.Code)
+	}
+	if n := q.inflight.Inflight(); n != 0 {
+		t.Errorf("in flight after the requests: %d", n)
+	}
+}
+
+func TestQueueAdminDuplicateIds(t *testing.T) {
+	ps, _ := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}, EndpointDef{Timeout: Duration(10 * time.Second)})
+	ar, err := ps.newAdminRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := ps.lookupEndpoint("held").Handler.queue
+
+	// both sent with the same id
+	var answers []chan *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		c := make(chan *httptest.ResponseRecorder, 1)
+		answers = append(answers, c)
+		r := httptest.NewRequest(http.MethodGet, "/held", nil)
+		r.Header.Set("X-Request-ID", "dup")
+		go func() {
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, r)
+			c <- w
+		}()
+		for n := q.Len(); q.Len() == n; {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	w := doAdmin(ar, http.MethodGet, "/_admin/v1/queue/held", "")
+	var list struct {
+		Requests []QueuedRequest `json:"requests"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Requests) != 2 || list.Requests[0].Id != "dup" || list.Requests[1].Id != "dup-2" {
+		t.Fatalf("list: got %s", w.Body)
+	}
+
+	// only the first one is canceled
+	if w := doAdmin(ar, http.MethodDelete, "/_admin/v1/queue/held/dup", ""); w.Code != http.StatusOK {
+		t.Errorf("cancel: got %d %s", w.Code, w.Body)
+	}
+	if w := <-answers[0]; w.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled: got %d %q", w.Code, w.Body.String())
+	}
+	if n := q.Len(); n != 1 {
+		t.Fatalf("waiting after the cancel: %d", n)
+	}
+
+	if w := doAdmin(ar, http.MethodPost, "/_admin/v1/queue/held/dup-2/release", ""); w.Code != http.StatusOK {
+		t.Errorf("release: got %d %s", w.Code, w.Body)
+	}
+	if w := <-answers[1]; w.Code != http.StatusOK || w.Body.String() != "dup-2" {
+		t.Errorf("released: got %d %q", w.Code, w.Body.String())
+	}
+	if n := q.inflight.Inflight(); n != 0 {
+		t.Errorf("in flight after the requests: %d", n)
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NameHitRateLimit = "hit_rate_limit"
+
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyHeader = "header:"
+	RateLimitKeyPath   = "path:"
+
+	DefaultRateLimitMaxClients = 10000
+)
+
+// RateLimitDef limits the requests of each client of an endpoint with a
+// token bucket: `rate` requests per second, in bursts of up to `burst`
+// (defaults to the rate). Clients are told apart by `key`: `ip` (default),
+// `header:<name>`, e.g. an API key, or `path:<n>`, the n-th segment of the
+// path below the endpoint's (from 1). Requests without the header or
+// segment are told apart by their IP. At most `max_clients` buckets are
+// kept, dropping the least recently used. A zero rate means no limit.
+type RateLimitDef struct {
+	Rate       float64 `json:"rate"        yaml:"rate"`
+	Burst      int     `json:"burst"       yaml:"burst"`
+	Key        string  `json:"key"         yaml:"key"`
+	MaxClients int     `json:"max_clients" yaml:"max_clients"`
+}
+
+func (rd *RateLimitDef) Validate() error {
+	if rd.Rate < 0 || rd.Burst < 0 || rd.MaxClients < 0 {
+		return fmt.Errorf("rate_limit: rate, burst and max_clients must not be negative")
+	}
+
+	switch {
+	case rd.Key == "", rd.Key == RateLimitKeyIP:
+	case strings.HasPrefix(rd.Key, RateLimitKeyHeader) && len(rd.Key) > len(RateLimitKeyHeader):
+	case strings.HasPrefix(rd.Key, RateLimitKeyPath):
+		if n, err := strconv.Atoi(strings.TrimPrefix(rd.Key, RateLimitKeyPath)); err != nil || n < 1 {
+			return fmt.Errorf("rate_limit: invalid path segment in key: %q", rd.Key)
+		}
+	default:
+		return fmt.Errorf("rate_limit: invalid key: %q", rd.Key)
+	}
+
+	return nil
+}
+
+func (rd *RateLimitDef) enabled() bool {
+	return rd.Rate > 0
+}
+
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client of an endpoint. Its limits
+// can be changed at runtime, keeping the buckets.
+type rateLimiter struct {
+	def  RateLimitDef
+	path string
+
+	buckets map[string]*list.Element
+	lru     *list.List
+
+	sync.Mutex
+}
+
+func newRateLimiter(rd RateLimitDef, path string) *rateLimiter {
+	return &rateLimiter{
+		def:     rd,
+		path:    path,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// update changes the limits. Buckets keep their tokens, capped to the new
+// burst.
+func (l *rateLimiter) update(rd RateLimitDef) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.def = rd
+	burst := l.burst()
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		b := e.Value.(*bucket)
+		b.tokens = math.Min(b.tokens, burst)
+	}
+}
+
+// Def returns the current limits.
+func (l *rateLimiter) Def() RateLimitDef {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.def
+}
+
+// Clients returns the number of clients tracked.
+func (l *rateLimiter) Clients() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.lru.Len()
+}
+
+// burst returns the size of the buckets. The caller must hold the lock.
+func (l *rateLimiter) burst() float64 {
+	if l.def.Burst > 0 {
+		return float64(l.def.Burst)
+	}
+	return math.Max(math.Ceil(l.def.Rate), 1)
+}
+
+// client returns the key of the bucket of a request.
+func (l *rateLimiter) client(r *http.Request, key string) string {
+	switch {
+	case strings.HasPrefix(key, RateLimitKeyHeader):
+		if v := r.Header.Get(strings.TrimPrefix(key, RateLimitKeyHeader)); v != "" {
+			return key + "=" + v
+		}
+	case strings.HasPrefix(key, RateLimitKeyPath):
+		n, _ := strconv.Atoi(strings.TrimPrefix(key, RateLimitKeyPath))
+		rest := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(l.path, "/"))
+		segments := strings.Split(strings.Trim(rest, "/"), "/")
+		if n <= len(segments) && segments[n-1] != "" {
+			return key + "=" + segments[n-1]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return RateLimitKeyIP + "=" + host
+}
+
+// allow takes a token from the bucket of the request's client. When it is
+// empty, it returns how long until the next token.
+func (l *rateLimiter) allow(r *http.Request, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.def.enabled() {
+		return true, 0
+	}
+
+	client := l.client(r, l.def.Key)
+	burst := l.burst()
+
+	var b *bucket
+	if e, ok := l.buckets[client]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.def.Rate)
+		b.last = now
+	} else {
+		b = &bucket{client: client, tokens: burst, last: now}
+		l.buckets[client] = l.lru.PushFront(b)
+
+		max := l.def.MaxClients
+		if max == 0 {
+			max = DefaultRateLimitMaxClients
+		}
+		for l.lru.Len() > max {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*bucket).client)
+			l.lru.Remove(oldest)
+		}
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.def.Rate * float64(time.Second))
+}
+
+// rateLimited answers a request over the limit of its client with the
+// hit_rate_limit response.
+func (eh *EndpointHandler) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := eh.limiter.allow(r, time.Now())
+	if ok {
+		return false
+	}
+
+	eh.metrics.Inc(MetricRateLimitedTotal, eh.def.Id)
+
+	retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", retryAfter)
+	eh.writeResponse(w, r, NameHitRateLimit, map[string]string{"RETRY_AFTER": retryAfter})
+	return true
+}
+
+// SetRateLimit changes the rate limit of an endpoint at runtime, keeping
+// the buckets of its clients.
+func (ps *ProxyServer) SetRateLimit(id string, rd RateLimitDef) (int, error) {
+	if err := rd.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	var endp *Endpoint
+	for _, e := range ps.endpoints {
+		if e.Id == id {
+			endp = e
+		}
+	}
+	if endp == nil {
+		return http.StatusNotFound, ErrNotFoundEndpoint
+	}
+
+	endp.Handler.limiter.update(rd)
+	endp.Def.RateLimit = rd
+	for i := range ps.Cfg.Endpoints {
+		if ps.Cfg.Endpoints[i].Id == id {
+			ps.Cfg.Endpoints[i].RateLimit = rd
+		}
+	}
+	ps.markChanged()
+
+	log.Printf("[runtime] rate limit of %s: rate=%v burst=%d key=%q\n", id, rd.Rate, rd.Burst, rd.Key)
+	return http.StatusOK, nil
+}
+
+// AdminGetRateLimit reports the rate limit of an endpoint and how many
+// clients it tracks.
+func (ps *ProxyServer) AdminGetRateLimit(w http.ResponseWriter, r *http.Request) {
+	e := ps.lookupEndpoint(adminParam(r, "id"))
+	if e == nil {
+		writeJSONError(w, http.StatusNotFound, ErrNotFoundEndpoint.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rate_limit": e.Handler.limiter.Def(),
+		"clients":    e.Handler.limiter.Clients(),
+	})
+}
+
+// AdminSetRateLimit changes the rate limit of an endpoint; a zero rate
+// lifts it.
+func (ps *ProxyServer) AdminSetRateLimit(w http.ResponseWriter, r *http.Request) {
+	var rd RateLimitDef
+	if err := readJSON(r, &rd); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+		return
+	}
+
+	id := adminParam(r, "id")
+	code, err := ps.SetRateLimit(id, rd)
+	ps.finishChange(w, r, code, err, "endpoint", id)
+}
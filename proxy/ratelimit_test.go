@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBuckets(t *testing.T) {
+	l := newRateLimiter(RateLimitDef{Rate: 1, Burst: 2, Key: "path:1", MaxClients: 2}, "/api/")
+	now := time.Unix(1000, 0)
+
+	send := func(path string, now time.Time) (bool, time.Duration) {
+		return l.allow(httptest.NewRequest(http.MethodGet, path, nil), now)
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := send("/api/acme/orders", now); !ok {
+			t.Fatalf("request %d within the burst rejected", i)
+		}
+	}
+	if ok, wait := send("/api/acme/users", now); ok || wait != time.Second {
+		t.Errorf("over the burst: got %v, %s", ok, wait)
+	}
+	if ok, _ := send("/api/other", now); !ok {
+		t.Error("another client rejected")
+	}
+	if ok, _ := send("/api/acme", now.Add(500*time.Millisecond)); ok {
+		t.Error("allowed before a token was back")
+	}
+	if ok, _ := send("/api/acme", now.Add(1500*time.Millisecond)); !ok {
+		t.Error("rejected after a token was back")
+	}
+
+	// the least recently used client is dropped
+	send("/api/third", now)
+	if n := l.Clients(); n != 2 {
+		t.Errorf("clients: got %d", n)
+	}
+}
+
+func TestRateLimitEndpoint(t *testing.T) {
+	ps, ar := newTestAdmin(t)
+	if _, err := ps.AddEndpoint(EndpointDef{Id: "limited", Path: "/limited", Type: TypeRespond}); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		r.Header.Set("X-Api-Key", "k1")
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, r)
+		return w
+	}
+
+	if w := send(); w.Code == http.StatusTooManyRequests {
+		t.Fatal("limited without a rate limit")
+	}
+
+	w := doAdmin(ar, http.MethodPut, "/_admin/v1/endpoints/limited/rate_limit", `{"rate": 0.5, "key": "header:X-Api-Key"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set: got %d %s", w.Code, w.Body)
+	}
+
+	if w := send(); w.Code == http.StatusTooManyRequests {
+		t.Error("first request limited")
+	}
+	w = send()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("second request: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if v := ps.metrics.Value(MetricRateLimitedTotal, "limited"); v != 1 {
+		t.Errorf("metric: got %v", v)
+	}
+
+	w = doAdmin(ar, http.MethodGet, "/_admin/v1/endpoints/limited/rate_limit", "")
+	if w.Code != http.StatusOK || ps.lookupEndpoint("limited").Def.RateLimit.Rate != 0.5 {
+		t.Errorf("get: got %d %s", w.Code, w.Body)
+	}
+}
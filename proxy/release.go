@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RampStart is the share of the limits allowed right after the
+	// upstream becomes ready, growing linearly to all of them.
+	RampStart = 0.1
+)
+
+// ReleaseDef protects an upstream from the burst of held requests when its
+// gate opens: at most `max_concurrent` requests in flight and `rate`
+// requests per second, both ramped up linearly over `ramp` after the gate
+// opens or the upstream becomes available. Zero means no limit.
+type ReleaseDef struct {
+	MaxConcurrent int      `json:"max_concurrent" yaml:"max_concurrent"`
+	Rate          float64  `json:"rate"           yaml:"rate"`
+	Ramp          Duration `json:"ramp"           yaml:"ramp"`
+}
+
+type releaser struct {
+	def  *ReleaseDef
+	ramp time.Duration
+	next time.Time
+
+	// unix nano since the upstream is ready, 0 while it is not
+	readySince int64
+
+	sync.Mutex
+}
+
+func (rd *ReleaseDef) Validate() error {
+	if rd.MaxConcurrent < 0 || rd.Rate < 0 {
+		return fmt.Errorf("release: max_concurrent and rate must not be negative")
+	}
+
+	if rd.Ramp < 0 {
+		return fmt.Errorf("release: invalid ramp: %s", time.Duration(rd.Ramp))
+	}
+	if rd.Ramp > 0 && rd.MaxConcurrent == 0 && rd.Rate == 0 {
+		return fmt.Errorf("release: ramp requires max_concurrent or rate")
+	}
+
+	return nil
+}
+
+func newReleaser(rd *ReleaseDef) *releaser {
+	return &releaser{def: rd, ramp: time.Duration(rd.Ramp)}
+}
+
+// factor returns the share of the limits allowed at now.
+func (r *releaser) factor(now time.Time) float64 {
+	since := atomic.LoadInt64(&r.readySince)
+	if r.ramp == 0 || since == 0 {
+		return 1
+	}
+
+	f := RampStart + (1-RampStart)*float64(now.UnixNano()-since)/float64(r.ramp)
+	return math.Min(f, 1)
+}
+
+// limits returns the concurrency and rate allowed at now.
+func (r *releaser) limits(now time.Time) (int, float64) {
+	f := r.factor(now)
+
+	concurrent := 0
+	if r.def.MaxConcurrent > 0 {
+		concurrent = int(math.Ceil(float64(r.def.MaxConcurrent) * f))
+	}
+
+	return concurrent, r.def.Rate * f
+}
+
+// updateReady starts the ramp when the upstream becomes ready: gate opened
+// and available.
+func (us *UpstreamHandler) updateReady() {
+	if us.release == nil {
+		return
+	}
+
+	if us.GetGateState() != GateOpened || us.GetUpstreamStatus() != StatusAvailable {
+		atomic.StoreInt64(&us.release.readySince, 0)
+		return
+	}
+
+	if atomic.CompareAndSwapInt64(&us.release.readySince, 0, time.Now().UnixNano()) && us.release.ramp > 0 {
+		log.Printf("[upstream:%s] ready, ramping up over %s\n", us.def.Id, us.release.ramp)
+	}
+}
+
+// admit takes an in-flight slot for a request released from a queue. When
+// the upstream cannot take it yet, it returns how long to wait before
+// asking again, or 0 when only a change of the upstream (gate, status or a
+// free slot) can let it in.
+func (us *UpstreamHandler) admit(now time.Time) (bool, time.Duration) {
+	if us.GetGateState() != GateOpened || us.GetUpstreamStatus() != StatusAvailable {
+		return false, 0
+	}
+
+	// a half open breaker lets a few probes in
+	if us.probing() {
+		return false, 0
+	}
+
+	r := us.release
+	if r == nil {
+		atomic.AddInt32(&us.InFlight, 1)
+		return true, 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	concurrent, rate := r.limits(now)
+
+	if concurrent > 0 && int(us.GetInFlight()) >= concurrent {
+		// the ramp raises the limit over time
+		if r.ramp > 0 && r.factor(now) < 1 {
+			return false, r.ramp / 100
+		}
+		return false, 0
+	}
+
+	if rate > 0 {
+		if now.Before(r.next) {
+			return false, r.next.Sub(now)
+		}
+		if r.next.Before(now) {
+			r.next = now
+		}
+		r.next = r.next.Add(time.Duration(float64(time.Second) / rate))
+	}
+
+	atomic.AddInt32(&us.InFlight, 1)
+	return true, 0
+}
+
+// ReleaseInfo reports the limits in effect.
+type ReleaseInfo struct {
+	MaxConcurrent int     `json:"max_concurrent"`
+	Rate          float64 `json:"rate"`
+	Ramp          float64 `json:"ramp"`
+}
+
+func (us *UpstreamHandler) ReleaseInfo() *ReleaseInfo {
+	if us.release == nil {
+		return nil
+	}
+
+	now := time.Now()
+	concurrent, rate := us.release.limits(now)
+
+	return &ReleaseInfo{
+		MaxConcurrent: concurrent,
+		Rate:          rate,
+		Ramp:          us.release.factor(now),
+	}
+}
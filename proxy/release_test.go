@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReleaseRamp(t *testing.T) {
+	def := &ReleaseDef{MaxConcurrent: 10, Rate: 100, Ramp: Duration(10 * time.Second)}
+	if err := def.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	us := &UpstreamHandler{
+		def:            &UpstreamDef{Id: "up"},
+		GateState:      GateClosed,
+		UpstreamStatus: StatusAvailable,
+		release:        newReleaser(def),
+	}
+
+	if ok, _ := us.admit(time.Now()); ok {
+		t.Fatal("admitted while the gate is closed")
+	}
+
+	us.UpdateGate(GateOpened)
+	start := time.Unix(0, us.release.readySince)
+
+	// 10% right after opening: one request in flight, 10 per second
+	if c, r := us.release.limits(start); c != 1 || r != 10 {
+		t.Errorf("start: got %d, %v", c, r)
+	}
+	if ok, _ := us.admit(start); !ok {
+		t.Error("first request not admitted")
+	}
+	if ok, wait := us.admit(start); ok || wait != 100*time.Millisecond {
+		t.Errorf("second request: got %v, %s", ok, wait)
+	}
+
+	// half way
+	if c, r := us.release.limits(start.Add(5 * time.Second)); c != 6 || r < 54.9 || r > 55.1 {
+		t.Errorf("half way: got %d, %v", c, r)
+	}
+
+	// ramp done; the rate still spaces requests
+	end := start.Add(time.Minute)
+	us.InFlight = 0
+	if ok, _ := us.admit(end); !ok {
+		t.Error("not admitted after the ramp")
+	}
+	if ok, wait := us.admit(end); ok || wait != 10*time.Millisecond {
+		t.Errorf("rate: got %v, %s", ok, wait)
+	}
+
+	// closing the gate restarts the ramp on the next opening
+	us.UpdateGate(GateClosed)
+	if us.release.readySince != 0 {
+		t.Error("ramp not reset")
+	}
+
+	if err := (&ReleaseDef{Ramp: Duration(30 * time.Second)}).Validate(); err == nil {
+		t.Error("ramp without limits accepted")
+	}
+}
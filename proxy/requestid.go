@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const (
+	HeaderRequestID = "X-Request-ID"
+
+	// longer incoming ids are replaced
+	MaxRequestIDLength = 128
+)
+
+// requestID returns the id of a request: its X-Request-ID header when
+// given and printable, else a new random UUID.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(HeaderRequestID)
+	if id == "" || len(id) > MaxRequestIDLength {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("buffy: no random source: " + err.Error())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// setRequestID gives a request its id, sent upstream and returned to the
+// client, and returns it. An id already taken, as reported by taken, gets
+// a number so that it is unique.
+func setRequestID(r *http.Request, taken func(string) bool) string {
+	base := requestID(r)
+	id := base
+	for n := 2; taken != nil && taken(id); n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	r.Header.Set(HeaderRequestID, id)
+	return id
+}
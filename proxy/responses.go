@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses generated by buffy itself. An endpoint overrides one by
+// defining a response with the same name.
+const (
+	NameGateClosed     = "gate_closed"
+	NameUpstreamBroken = "upstream_broken"
+	NameFlushed        = "flushed"
+)
+
+var ErrNotFoundResponse = errors.New("not found name")
+
+// DefaultResponses are used when an endpoint does not define a response
+// generated by buffy.
+var DefaultResponses = map[string]EndpointResponseDef{
+	NameHitTimeout: {
+		Name:       NameHitTimeout,
+		ReturnCode: http.StatusServiceUnavailable,
+		Content:    `{"status": "timeout", "endpoint": "{{ID}}", "timeout": "{{TIMEOUT}}"}`,
+	},
+	NameGateClosed: {
+		Name:       NameGateClosed,
+		ReturnCode: http.StatusServiceUnavailable,
+		Content:    `{"status": "gate closed", "endpoint": "{{ID}}", "upstream": "{{UPSTREAM}}"}`,
+	},
+	NameHitMaxQueue: {
+		Name:       NameHitMaxQueue,
+		ReturnCode: http.StatusServiceUnavailable,
+		Content:    `{"status": "queue full", "endpoint": "{{ID}}", "max_queue": {{MAX_QUEUE}}}`,
+	},
+	NameUpstreamBroken: {
+		Name:       NameUpstreamBroken,
+		ReturnCode: http.StatusServiceUnavailable,
+		Content:    `{"status": "upstream broken", "endpoint": "{{ID}}", "upstream": "{{UPSTREAM}}"}`,
+	},
+	NameFlushed: {
+		Name:       NameFlushed,
+		ReturnCode: http.StatusServiceUnavailable,
+		Content:    `{"status": "flushed", "endpoint": "{{ID}}"}`,
+	},
+	NameHitRateLimit: {
+		Name:       NameHitRateLimit,
+		ReturnCode: http.StatusTooManyRequests,
+		Content:    `{"status": "rate limited", "endpoint": "{{ID}}", "retry_after": {{RETRY_AFTER}}}`,
+	},
+}
+
+// responseFallback names the response used when an endpoint does not
+// define one, before the default: endpoints that only define hit_timeout
+// keep using it while the gate is closed.
+var responseFallback = map[string]string{
+	NameGateClosed: NameHitTimeout,
+}
+
+// ResolveResponse returns the response of an endpoint by name, or its
+// fallback, or the default.
+func (ed *EndpointDef) ResolveResponse(name string, basepath string) (int, string, error) {
+	for n := name; n != ""; n = responseFallback[n] {
+		code, content, err := ed.GetResponseWithName(n, basepath)
+		if err != ErrNotFoundResponse {
+			return code, content, err
+		}
+	}
+
+	if d, ok := DefaultResponses[name]; ok {
+		return d.ReturnCode, d.Content, nil
+	}
+
+	return http.StatusInternalServerError, "", ErrNotFoundResponse
+}
+
+// renderTemplate replaces every {{NAME}} of vars in content.
+func renderTemplate(content string, vars map[string]string) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "{{"+k+"}}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(content)
+}
+
+// templateVars are the values available to every response of an endpoint.
+// Callers add their own, e.g. ELAPSED or ERROR.
+func (eh *EndpointHandler) templateVars(r *http.Request, extra map[string]string) map[string]string {
+	vars := map[string]string{
+		"URL":       r.RequestURI,
+		"ID":        eh.def.Id,
+		"UPSTREAM":  eh.UpstreamId(),
+		"TIMEOUT":   formatSeconds(eh.def.QueueTimeout()),
+		"MAX_QUEUE": strconv.Itoa(eh.def.MaxQueue),
+	}
+	for k, v := range extra {
+		vars[k] = v
+	}
+	return vars
+}
+
+// render resolves a named response and fills in its template.
+func (eh *EndpointHandler) render(name string, r *http.Request, extra map[string]string) (int, string) {
+	cfg := eh.ctx.Value(ctxKeyConfig).(*BuffyConfig)
+
+	code, content, err := eh.def.ResolveResponse(name, cfg.BasePath)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("buffy[yaml]: not found a response body for '%s' : %s", name, err)
+	}
+
+	return code, renderTemplate(content, eh.templateVars(r, extra))
+}
+
+// writeResponse answers a request with a named response.
+func (eh *EndpointHandler) writeResponse(w http.ResponseWriter, r *http.Request, name string, extra map[string]string) {
+	code, content := eh.render(name, r, extra)
+
+	eh.addHeaders(w, r, eh.def)
+
+	w.WriteHeader(code)
+	w.Write([]byte(content))
+}
+
+// newResponse builds a named response in place of the upstream's.
+func (eh *EndpointHandler) newResponse(r *http.Request, name string, extra map[string]string) *http.Response {
+	code, content := eh.render(name, r, extra)
+
+	return &http.Response{
+		Request:    r,
+		Header:     http.Header{},
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(content))),
+	}
+}
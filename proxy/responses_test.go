@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResolveResponse(t *testing.T) {
+	ed := &EndpointDef{
+		Id: "ep",
+		Response: []EndpointResponseDef{
+			{Name: NameHitTimeout, ReturnCode: 504, Content: "timeout {{ID}} after {{TIMEOUT}}s"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		code    int
+		content string
+	}{
+		{NameHitTimeout, 504, "timeout {{ID}} after {{TIMEOUT}}s"},
+		// falls back to hit_timeout
+		{NameGateClosed, 504, "timeout {{ID}} after {{TIMEOUT}}s"},
+		{NameHitMaxQueue, http.StatusServiceUnavailable, DefaultResponses[NameHitMaxQueue].Content},
+		{NameUpstreamBroken, http.StatusServiceUnavailable, DefaultResponses[NameUpstreamBroken].Content},
+	} {
+		code, content, err := ed.ResolveResponse(tt.name, ".")
+		if err != nil || code != tt.code || content != tt.content {
+			t.Errorf("%s: got %d %q %v", tt.name, code, content, err)
+		}
+	}
+
+	if _, _, err := ed.ResolveResponse(NameOK, "."); err != ErrNotFoundResponse {
+		t.Errorf("ok: got %v", err)
+	}
+
+	got := renderTemplate("{{ID}} {{TIMEOUT}} {{UNKNOWN}}", map[string]string{"ID": "ep", "TIMEOUT": "5"})
+	if got != "ep 5 {{UNKNOWN}}" {
+		t.Errorf("template: got %q", got)
+	}
+}
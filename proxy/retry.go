@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryDef sends a request upstream again when it fails: up to `attempts`
+// tries in all, `backoff` apart and doubled after each one up to
+// `max_backoff`. Connection errors are always retried, since the request
+// never reached the upstream. Other errors and the `on_status` codes are
+// retried only for idempotent methods, or requests carrying an
+// Idempotency-Key, unless `all_methods` is set.
+type RetryDef struct {
+	Attempts   int      `json:"attempts"    yaml:"attempts"`
+	Backoff    Duration `json:"backoff"     yaml:"backoff"`
+	MaxBackoff Duration `json:"max_backoff" yaml:"max_backoff"`
+	OnStatus   []int    `json:"on_status"   yaml:"on_status"`
+	AllMethods bool     `json:"all_methods" yaml:"all_methods"`
+}
+
+func (rd *RetryDef) Validate() error {
+	if rd.Attempts < 0 || rd.Backoff < 0 || rd.MaxBackoff < 0 {
+		return fmt.Errorf("retry: attempts and backoff must not be negative")
+	}
+
+	for _, code := range rd.OnStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retry: invalid status: %d", code)
+		}
+	}
+
+	return nil
+}
+
+// enabled reports whether a policy is configured. Without one, requests
+// that could not connect go back to the queue until their timeout and
+// other failures are answered at once.
+func (rd *RetryDef) enabled() bool {
+	return rd.Attempts > 0
+}
+
+// allows reports whether a request sent upstream may be sent again.
+func (rd *RetryDef) allows(r *http.Request) bool {
+	return rd.AllMethods || idempotent(r)
+}
+
+func (rd *RetryDef) onStatus(code int) bool {
+	for _, c := range rd.OnStatus {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff is the pause before the given retry, starting at 1.
+func (rd *RetryDef) backoff(retry int, interval time.Duration) time.Duration {
+	d := time.Duration(rd.Backoff)
+	if d == 0 {
+		d = interval
+	}
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if rd.MaxBackoff > 0 && d >= time.Duration(rd.MaxBackoff) {
+			break
+		}
+	}
+	if rd.MaxBackoff > 0 && d > time.Duration(rd.MaxBackoff) {
+		d = time.Duration(rd.MaxBackoff)
+	}
+	return d
+}
+
+// idempotent follows net/http: safe methods, PUT and DELETE, and requests
+// with an idempotency key.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, key := r.Header["Idempotency-Key"]
+	_, xkey := r.Header["X-Idempotency-Key"]
+	return key || xkey
+}
+
+// connectError reports an error returned before the request was written:
+// the upstream did not see it.
+func connectError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// replayable buffers the body of a request so that every attempt sends it
+// from the start.
+func replayable(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return nil
+	}
+
+	bs, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(bs)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+// rewind resets the body of a request for another attempt.
+func rewind(r *http.Request) {
+	if r.GetBody != nil {
+		r.Body, _ = r.GetBody()
+	}
+}
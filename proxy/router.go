@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminRouter dispatches admin requests by method and path. Path segments
+// written as {name} match any single segment and are available to the
+// handler through adminParam.
+type AdminRouter struct {
+	prefix string
+	guard  *adminGuard
+	routes []*adminRoute
+}
+
+type adminRoute struct {
+	method   string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+type CtxKeyAdminParams struct{}
+
+var ctxKeyAdminParams CtxKeyAdminParams
+
+func NewAdminRouter(prefix string, guard *adminGuard) *AdminRouter {
+	return &AdminRouter{prefix: strings.TrimSuffix(prefix, "/"), guard: guard}
+}
+
+// Handle registers a handler under the admin path. An empty method matches
+// every method.
+func (ar *AdminRouter) Handle(method, pattern, role string, h http.HandlerFunc) {
+	ar.HandleAbs(method, ar.prefix+pattern, role, h)
+}
+
+// HandleAbs registers a handler on an absolute path, outside the admin path.
+func (ar *AdminRouter) HandleAbs(method, pattern, role string, h http.HandlerFunc) {
+	ar.routes = append(ar.routes, &adminRoute{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  ar.guard.wrap(role, h),
+	})
+}
+
+func (ar *AdminRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+
+	var allowed []string
+	for _, rt := range ar.routes {
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+
+		if rt.method != "" && rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+
+		if len(params) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyAdminParams, params))
+		}
+		rt.handler(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, "not found: "+r.URL.Path)
+}
+
+func (rt *adminRoute) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// adminParam returns a path parameter matched by the admin router.
+func adminParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(ctxKeyAdminParams).(map[string]string)
+	return params[name]
+}
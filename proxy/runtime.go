@@ -0,0 +1,544 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+var (
+	ErrAlreadyExists  = errors.New("already exists")
+	ErrUpstreamInUse  = errors.New("upstream is used by an endpoint")
+	ErrIdMismatch     = errors.New("id in body does not match the path")
+	ErrNoConfigToSave = errors.New("no config file to persist to")
+)
+
+// Runtime changes to upstreams and endpoints are validated against a copy
+// of the whole config before being applied, exactly like the YAML file.
+// Every operation returns an HTTP status code describing the failure.
+
+func (ps *ProxyServer) AddUpstream(def UpstreamDef) (int, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if _, err := ps.LookupUpstreamWithIds([]string{def.Id}); err == nil {
+		return http.StatusConflict, ErrAlreadyExists
+	}
+
+	cfg := ps.Cfg.Clone()
+	cfg.Upstreams = append(cfg.Upstreams, def)
+	if err := cfg.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	up, err := NewUpstream(ps.ctx, def, ps.notifyC)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ps.upstreams = append(ps.upstreams, up)
+	ps.Cfg.Upstreams = cfg.Upstreams
+
+	ps.markChanged()
+
+	log.Printf("[runtime] upstream added: %s\n", def.Id)
+	return http.StatusCreated, nil
+}
+
+func (ps *ProxyServer) UpdateUpstream(id string, def UpstreamDef) (int, error) {
+	if def.Id == "" {
+		def.Id = id
+	}
+	if def.Id != id {
+		return http.StatusBadRequest, ErrIdMismatch
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	old, err := ps.LookupUpstreamWithIds([]string{id})
+	if err != nil {
+		return http.StatusNotFound, ErrNotFoundUpstream
+	}
+
+	cfg := ps.Cfg.Clone()
+	for i := range cfg.Upstreams {
+		if cfg.Upstreams[i].Id == id {
+			cfg.Upstreams[i] = def
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	up, err := NewUpstream(ps.ctx, def, ps.notifyC)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	upstreams := make([]*Upstream, len(ps.upstreams))
+	for i, u := range ps.upstreams {
+		upstreams[i] = u
+		if u == old {
+			upstreams[i] = up
+		}
+	}
+
+	// endpoints keep a reverse proxy to their upstreams, so recreate them,
+	// all of them before anything is replaced
+	endpoints := make(map[int]*Endpoint)
+	for i, e := range ps.endpoints {
+		if !containsAny([]string{id}, e.Def.upstreamIds()) {
+			continue
+		}
+		endp, err := ps.newEndpoint(*e.Def, upstreams)
+		if err != nil {
+			up.Stop()
+			return http.StatusInternalServerError, err
+		}
+		endpoints[i] = endp
+	}
+
+	up.Handler.inheritGate(old.Handler)
+	ps.upstreams = upstreams
+	for i, endp := range endpoints {
+		endp.Handler.takeOver(ps.endpoints[i].Handler)
+		ps.endpoints[i] = endp
+	}
+	// nothing waits on the old upstream any more
+	old.Stop()
+
+	ps.Cfg.Upstreams = cfg.Upstreams
+	ps.rebuildMux()
+
+	ps.markChanged()
+
+	log.Printf("[runtime] upstream updated: %s\n", id)
+	return http.StatusOK, nil
+}
+
+func (ps *ProxyServer) DeleteUpstream(id string) (int, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	old, err := ps.LookupUpstreamWithIds([]string{id})
+	if err != nil {
+		return http.StatusNotFound, ErrNotFoundUpstream
+	}
+
+	for _, e := range ps.endpoints {
+		for _, uid := range e.Def.upstreamIds() {
+			if uid == id {
+				return http.StatusConflict, ErrUpstreamInUse
+			}
+		}
+	}
+
+	var upstreams []*Upstream
+	for _, u := range ps.upstreams {
+		if u != old {
+			upstreams = append(upstreams, u)
+		}
+	}
+	ps.upstreams = upstreams
+	old.Stop()
+
+	var defs []UpstreamDef
+	for _, u := range ps.Cfg.Upstreams {
+		if u.Id != id {
+			defs = append(defs, u)
+		}
+	}
+	ps.Cfg.Upstreams = defs
+
+	ps.markChanged()
+
+	log.Printf("[runtime] upstream deleted: %s\n", id)
+	return http.StatusOK, nil
+}
+
+func (ps *ProxyServer) AddEndpoint(def EndpointDef) (int, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, e := range ps.endpoints {
+		if e.Id == def.Id {
+			return http.StatusConflict, ErrAlreadyExists
+		}
+	}
+
+	cfg := ps.Cfg.Clone()
+	cfg.Endpoints = append(cfg.Endpoints, def)
+	if err := cfg.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	endp, err := ps.newEndpoint(def, ps.upstreams)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ps.endpoints = append(ps.endpoints, endp)
+	ps.Cfg.Endpoints = cfg.Endpoints
+	ps.rebuildMux()
+
+	ps.markChanged()
+
+	log.Printf("[runtime] endpoint added: %s\n", def.Id)
+	return http.StatusCreated, nil
+}
+
+func (ps *ProxyServer) UpdateEndpoint(id string, def EndpointDef) (int, error) {
+	if def.Id == "" {
+		def.Id = id
+	}
+	if def.Id != id {
+		return http.StatusBadRequest, ErrIdMismatch
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	idx := -1
+	for i, e := range ps.endpoints {
+		if e.Id == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return http.StatusNotFound, ErrNotFoundEndpoint
+	}
+
+	cfg := ps.Cfg.Clone()
+	for i := range cfg.Endpoints {
+		if cfg.Endpoints[i].Id == id {
+			cfg.Endpoints[i] = def
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	endp, err := ps.newEndpoint(def, ps.upstreams)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// the requests held by the old endpoint move to the new one
+	endp.Handler.takeOver(ps.endpoints[idx].Handler)
+	ps.endpoints[idx] = endp
+	ps.Cfg.Endpoints = cfg.Endpoints
+	ps.rebuildMux()
+
+	ps.markChanged()
+
+	log.Printf("[runtime] endpoint updated: %s\n", id)
+	return http.StatusOK, nil
+}
+
+func (ps *ProxyServer) DeleteEndpoint(id string) (int, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	var endpoints []*Endpoint
+	var deleted *Endpoint
+	for _, e := range ps.endpoints {
+		if e.Id != id {
+			endpoints = append(endpoints, e)
+		} else {
+			deleted = e
+		}
+	}
+	if deleted == nil {
+		return http.StatusNotFound, ErrNotFoundEndpoint
+	}
+	ps.endpoints = endpoints
+	deleted.Handler.retire()
+
+	var defs []EndpointDef
+	for _, e := range ps.Cfg.Endpoints {
+		if e.Id != id {
+			defs = append(defs, e)
+		}
+	}
+	ps.Cfg.Endpoints = defs
+	ps.rebuildMux()
+
+	ps.markChanged()
+
+	log.Printf("[runtime] endpoint deleted: %s\n", id)
+	return http.StatusOK, nil
+}
+
+// newEndpoint creates an endpoint and attaches it to its upstreams, found
+// in upstreams. The caller must hold the lock.
+func (ps *ProxyServer) newEndpoint(def EndpointDef, all []*Upstream) (*Endpoint, error) {
+	endp, err := NewEndpoint(ps.ctx, def, ps.notifyC)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams, err := findUpstreams(all, def.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := endp.Handler.RegisterRoute(upstreams); err != nil {
+		return nil, err
+	}
+
+	fallbacks, err := findUpstreams(all, def.upstreamIds())
+	if err != nil {
+		return nil, err
+	}
+	endp.Handler.SetFallbacks(fallbacks)
+
+	return endp, nil
+}
+
+// takeOver moves the requests held by an endpoint replaced at runtime to
+// this one, keeping their order, or answers them when this one has no
+// queue. Requests still served by the old endpoint go on with this one's
+// queue and fallbacks.
+func (eh *EndpointHandler) takeOver(old *EndpointHandler) {
+	old.Lock()
+	old.successor = eh
+	old.Unlock()
+
+	if old.queue == nil {
+		return
+	}
+	if eh.queue == nil {
+		old.retire()
+		return
+	}
+	old.queue.handOver(eh.queue)
+}
+
+// retire answers the requests held by an endpoint deleted at runtime, and
+// those coming back to its queue for another attempt, with the flushed
+// response.
+func (eh *EndpointHandler) retire() {
+	if eh.queue == nil {
+		return
+	}
+	if n := eh.queue.closeWith(NameFlushed); n > 0 {
+		log.Printf("[runtime] endpoint %s: %d held requests flushed\n", eh.def.Id, n)
+	}
+}
+
+// current returns the endpoint replacing this one at runtime, or itself.
+func (eh *EndpointHandler) current() *EndpointHandler {
+	eh.Lock()
+	next := eh.successor
+	eh.Unlock()
+
+	if next == nil {
+		return eh
+	}
+	return next.current()
+}
+
+// PersistConfig writes the current upstreams and endpoints back to the
+// config file.
+func (ps *ProxyServer) PersistConfig() error {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if ps.Cfg.ConfigFilename == "" {
+		return ErrNoConfigToSave
+	}
+
+	if err := ps.Cfg.WriteConfigFile(ps.Cfg.ConfigFilename); err != nil {
+		return err
+	}
+
+	ps.overridden = false
+	ps.state.Touch()
+
+	return nil
+}
+
+// markChanged records a runtime change of upstreams or endpoints so that
+// it is saved to the state file and replicated to cluster peers. The
+// caller must hold the lock.
+func (ps *ProxyServer) markChanged() {
+	ps.overridden = true
+	ps.state.Touch()
+
+	// replaying a peer's change, which keeps its version
+	if ps.syncing {
+		return
+	}
+
+	ps.configVersion = time.Now().UnixNano()
+	ps.configNode = ps.cluster.NodeId()
+	ps.cluster.Touch()
+}
+
+// Reload reads the config file again and applies the differences of its
+// upstreams and endpoints. Listener, admin and notify settings need a
+// restart.
+func (ps *ProxyServer) Reload() (int, error) {
+	cfg, err := ReadConfigFile(ps.Cfg.ConfigFilename)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if code, err := ps.applyDefs(cfg); err != nil {
+		return code, err
+	}
+
+	// the config file is the reference again
+	ps.Lock()
+	ps.overridden = false
+	ps.Unlock()
+	ps.state.Touch()
+
+	log.Printf("[runtime] reloaded: %s\n", ps.Cfg.ConfigFilename)
+	return http.StatusOK, nil
+}
+
+// applyDefs applies the differences between the current upstreams and
+// endpoints and those of cfg. The new set is built in full before it is
+// swapped in at once, so that a failure changes nothing; unchanged
+// upstreams and endpoints are kept.
+func (ps *ProxyServer) applyDefs(cfg *BuffyConfig) (int, error) {
+	if err := cfg.Validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	oldUps := make(map[string]*Upstream)
+	for _, u := range ps.upstreams {
+		oldUps[u.Id] = u
+	}
+	oldEps := make(map[string]*Endpoint)
+	for _, e := range ps.endpoints {
+		oldEps[e.Id] = e
+	}
+
+	// upstreams first so that endpoints can refer to them
+	var upstreams, created []*Upstream
+	var replaced []string
+	for _, def := range cfg.Upstreams {
+		old, ok := oldUps[def.Id]
+		if current, _ := findUpstreamDef(ps.Cfg.Upstreams, def.Id); ok && reflect.DeepEqual(current, def) {
+			upstreams = append(upstreams, old)
+			continue
+		}
+
+		up, err := NewUpstream(ps.ctx, def, ps.notifyC)
+		if err != nil {
+			stopUpstreams(created)
+			return http.StatusBadRequest, err
+		}
+		upstreams = append(upstreams, up)
+		created = append(created, up)
+		replaced = append(replaced, def.Id)
+	}
+
+	// endpoints keep a reverse proxy to their upstreams, so those of a
+	// new upstream are recreated
+	var endpoints []*Endpoint
+	changed := len(created) > 0 || len(upstreams) != len(ps.upstreams) || len(cfg.Endpoints) != len(ps.endpoints)
+	for _, def := range cfg.Endpoints {
+		old, ok := oldEps[def.Id]
+		if current, _ := findEndpointDef(ps.Cfg.Endpoints, def.Id); ok && reflect.DeepEqual(current, def) && !containsAny(replaced, def.upstreamIds()) {
+			endpoints = append(endpoints, old)
+			continue
+		}
+
+		endp, err := ps.newEndpoint(def, upstreams)
+		if err != nil {
+			stopUpstreams(created)
+			return http.StatusBadRequest, err
+		}
+		endpoints = append(endpoints, endp)
+		changed = true
+	}
+
+	if !changed {
+		return http.StatusOK, nil
+	}
+
+	// swap
+	for _, up := range created {
+		if old, ok := oldUps[up.Id]; ok {
+			up.Handler.inheritGate(old.Handler)
+			log.Printf("[runtime] upstream updated: %s\n", up.Id)
+		} else {
+			log.Printf("[runtime] upstream added: %s\n", up.Id)
+		}
+	}
+	for _, e := range endpoints {
+		old, ok := oldEps[e.Id]
+		switch {
+		case !ok:
+			log.Printf("[runtime] endpoint added: %s\n", e.Id)
+		case old != e:
+			// the requests held by the old endpoint move to the new one
+			e.Handler.takeOver(old.Handler)
+			log.Printf("[runtime] endpoint updated: %s\n", e.Id)
+		}
+		delete(oldEps, e.Id)
+	}
+	for id, old := range oldEps {
+		old.Handler.retire()
+		log.Printf("[runtime] endpoint deleted: %s\n", id)
+	}
+
+	ps.upstreams = upstreams
+	ps.endpoints = endpoints
+	ps.Cfg.Upstreams = cfg.Upstreams
+	ps.Cfg.Endpoints = cfg.Endpoints
+	ps.rebuildMux()
+
+	// nothing waits on the replaced or deleted upstreams any more
+	kept := make(map[*Upstream]bool)
+	for _, up := range upstreams {
+		kept[up] = true
+	}
+	for id, old := range oldUps {
+		if kept[old] {
+			continue
+		}
+		old.Stop()
+		if _, ok := findUpstreamDef(cfg.Upstreams, id); !ok {
+			log.Printf("[runtime] upstream deleted: %s\n", id)
+		}
+	}
+
+	ps.markChanged()
+	return http.StatusOK, nil
+}
+
+// stopUpstreams ends the health checks of upstreams created for a change
+// that failed.
+func stopUpstreams(upstreams []*Upstream) {
+	for _, up := range upstreams {
+		up.Stop()
+	}
+}
+
+func findUpstreamDef(defs []UpstreamDef, id string) (UpstreamDef, bool) {
+	for _, u := range defs {
+		if u.Id == id {
+			return u, true
+		}
+	}
+	return UpstreamDef{}, false
+}
+
+func findEndpointDef(defs []EndpointDef, id string) (EndpointDef, bool) {
+	for _, e := range defs {
+		if e.Id == id {
+			return e, true
+		}
+	}
+	return EndpointDef{}, false
+}
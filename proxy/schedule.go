@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScheduleTick = 1 * time.Second
+)
+
+// ScheduleDef closes the gate of an upstream during a window, either every
+// time a cron expression matches (for `duration`) or between two fixed
+// times.
+type ScheduleDef struct {
+	Id       string   `json:"id"       yaml:"id"`
+	Cron     string   `json:"cron"     yaml:"cron"`
+	Duration Duration `json:"duration" yaml:"duration"`
+	From     string   `json:"from"     yaml:"from"`
+	To       string   `json:"to"       yaml:"to"`
+	Timezone string   `json:"timezone" yaml:"timezone"`
+}
+
+// Transition is an upcoming gate change caused by a schedule.
+type Transition struct {
+	Upstream string    `json:"upstream"`
+	Schedule string    `json:"schedule"`
+	Action   string    `json:"action"`
+	At       time.Time `json:"at"`
+}
+
+type schedule struct {
+	def      *ScheduleDef
+	cron     *cronExpr
+	duration time.Duration
+	from     time.Time
+	to       time.Time
+	loc      *time.Location
+}
+
+func (sd *ScheduleDef) Validate() error {
+	_, err := newSchedule(sd)
+	return err
+}
+
+func newSchedule(sd *ScheduleDef) (*schedule, error) {
+	if sd.Id == "" {
+		return nil, errors.New("schedule: missing 'id'")
+	}
+
+	s := &schedule{def: sd, loc: time.Local}
+
+	if sd.Timezone != "" {
+		loc, err := time.LoadLocation(sd.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: invalid timezone: %s", sd.Id, err)
+		}
+		s.loc = loc
+	}
+
+	var err error
+	switch {
+	case sd.Cron != "":
+		if s.cron, err = parseCron(sd.Cron); err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", sd.Id, err)
+		}
+		if s.duration = time.Duration(sd.Duration); s.duration <= 0 {
+			return nil, fmt.Errorf("schedule %s: invalid duration: %s", sd.Id, s.duration)
+		}
+
+	case sd.From != "" && sd.To != "":
+		if s.from, err = time.ParseInLocation(time.RFC3339, sd.From, s.loc); err != nil {
+			return nil, fmt.Errorf("schedule %s: invalid from: %s", sd.Id, err)
+		}
+		if s.to, err = time.ParseInLocation(time.RFC3339, sd.To, s.loc); err != nil {
+			return nil, fmt.Errorf("schedule %s: invalid to: %s", sd.Id, err)
+		}
+		if !s.to.After(s.from) {
+			return nil, fmt.Errorf("schedule %s: 'to' must be after 'from'", sd.Id)
+		}
+
+	default:
+		return nil, fmt.Errorf("schedule %s: requires 'cron' and 'duration', or 'from' and 'to'", sd.Id)
+	}
+
+	return s, nil
+}
+
+// active reports whether now is inside a window.
+func (s *schedule) active(now time.Time) bool {
+	if s.cron == nil {
+		return !now.Before(s.from) && now.Before(s.to)
+	}
+
+	start, ok := s.cron.next(now.In(s.loc).Add(-s.duration + time.Nanosecond))
+	return ok && !start.After(now)
+}
+
+// upcoming returns the next close and open transitions after now.
+func (s *schedule) upcoming(now time.Time) (time.Time, time.Time, bool) {
+	if s.cron == nil {
+		if !now.Before(s.to) {
+			return time.Time{}, time.Time{}, false
+		}
+		return s.from, s.to, true
+	}
+
+	if s.active(now) {
+		start, _ := s.cron.next(now.In(s.loc).Add(-s.duration + time.Nanosecond))
+		return start, start.Add(s.duration), true
+	}
+
+	start, ok := s.cron.next(now.In(s.loc))
+	return start, start.Add(s.duration), ok
+}
+
+// upcomingTransitions lists the next transitions of every schedule, in
+// chronological order.
+func upcomingTransitions(upstream string, schedules []*schedule, now time.Time) []Transition {
+	var ts []Transition
+	for _, s := range schedules {
+		start, end, ok := s.upcoming(now)
+		if !ok {
+			continue
+		}
+		if start.After(now) {
+			ts = append(ts, Transition{Upstream: upstream, Schedule: s.def.Id, Action: ActionClose, At: start})
+		}
+		ts = append(ts, Transition{Upstream: upstream, Schedule: s.def.Id, Action: ActionOpen, At: end})
+	}
+
+	sort.Slice(ts, func(i, j int) bool { return ts[i].At.Before(ts[j].At) })
+	return ts
+}
+
+// cronExpr is a standard 5-field cron expression:
+// minute hour day-of-month month day-of-week.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: expected 5 fields", expr)
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCronField(f, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %s", expr, err)
+		}
+		bits[i] = b
+	}
+
+	// sunday may be written as 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronExpr{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	if min == 0 && max == 6 {
+		max = 7
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:i])
+			hi, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range: %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value: %q", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range: %q", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (c *cronExpr) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	// like cron, a restricted day-of-month or day-of-week matches either
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute at or after t.
+func (c *cronExpr) next(t time.Time) (time.Time, bool) {
+	if m := t.Truncate(time.Minute); !m.Equal(t) {
+		t = m.Add(time.Minute)
+	}
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
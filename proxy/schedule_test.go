@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"0 2 * * *", "2026-10-19T10:00:00Z", "2026-10-20T02:00:00Z"},
+		{"*/15 * * * *", "2026-10-19T10:07:30Z", "2026-10-19T10:15:00Z"},
+		{"30 1 * * 0", "2026-10-19T10:00:00Z", "2026-10-25T01:30:00Z"},
+		{"0 0 1 1-3 *", "2026-10-19T10:00:00Z", "2027-01-01T00:00:00Z"},
+		{"0 2 * * *", "2026-10-20T02:00:00Z", "2026-10-20T02:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		from, _ := time.Parse(time.RFC3339, tt.from)
+		got, ok := c.next(from.UTC())
+		if !ok || got.Format(time.RFC3339) != tt.want {
+			t.Errorf("%s from %s: got %s, want %s", tt.expr, tt.from, got.Format(time.RFC3339), tt.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "a * * * *", "*/0 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	sc, err := newSchedule(&ScheduleDef{Id: "nightly", Cron: "0 2 * * *", Duration: Duration(30 * time.Minute), Timezone: "UTC"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+
+	for _, tt := range []struct {
+		now    string
+		active bool
+	}{
+		{"2026-10-19T01:59:59Z", false},
+		{"2026-10-19T02:00:00Z", true},
+		{"2026-10-19T02:29:59Z", true},
+		{"2026-10-19T02:30:00Z", false},
+	} {
+		if got := sc.active(at(tt.now)); got != tt.active {
+			t.Errorf("%s: got %v, want %v", tt.now, got, tt.active)
+		}
+	}
+
+	ts := upcomingTransitions("service1", []*schedule{sc}, at("2026-10-19T02:10:00Z"))
+	if len(ts) != 1 || ts[0].Action != ActionOpen || !ts[0].At.Equal(at("2026-10-19T02:30:00Z")) {
+		t.Errorf("unexpected transitions: %+v", ts)
+	}
+}
+
+func TestEvaluateSchedules(t *testing.T) {
+	def := &UpstreamDef{Id: "service1"}
+	sc, _ := newSchedule(&ScheduleDef{Id: "freeze", From: "2026-10-19T02:00:00Z", To: "2026-10-19T03:00:00Z"})
+
+	us := &UpstreamHandler{
+		def:       def,
+		notiC:     make(chan string, 10),
+		GateState: GateOpened,
+		schedules: []*schedule{sc},
+		windows:   make(map[string]bool),
+	}
+
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+
+	us.evaluateSchedules(at("2026-10-19T02:00:00Z"))
+	if us.GetGateState() != GateClosed {
+		t.Error("window start should close the gate")
+	}
+
+	us.evaluateSchedules(at("2026-10-19T03:00:00Z"))
+	if us.GetGateState() != GateOpened {
+		t.Error("window end should reopen the gate")
+	}
+
+	// a manual close during a window is not undone by the schedule
+	us.windows["freeze"] = false
+	us.evaluateSchedules(at("2026-10-19T02:30:00Z"))
+	us.SetGate(GateClosed, "admin:oncall", "hold", 0)
+	us.evaluateSchedules(at("2026-10-19T03:00:00Z"))
+	if us.GetGateState() != GateClosed {
+		t.Error("schedule should not reopen a manually closed gate")
+	}
+
+	if len(us.notiC) != 4 {
+		t.Errorf("expected 4 notifications, got %d", len(us.notiC))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -30,6 +31,18 @@ type ProxyServer struct {
 	endpoints     []*Endpoint
 	notifyManager *NotifyManager
 	notifyC       chan string
+	metrics       *Metrics
+	state         *StateStore
+	cluster       *Cluster
+	inflight      *inflightLimit
+
+	// upstreams or endpoints were changed at runtime and not persisted
+	overridden bool
+
+	// version and origin of the last runtime change, for cluster sync
+	configVersion int64
+	configNode    string
+	syncing       bool
 
 	mux *http.ServeMux
 
@@ -43,6 +56,8 @@ type Upstream struct {
 	Endpoint string           `json:"endpoint"`
 	Def      *UpstreamDef     `json:"-"`
 	Handler  *UpstreamHandler `json:"handler"`
+
+	url *url.URL
 }
 
 type Endpoint struct {
@@ -53,20 +68,55 @@ type Endpoint struct {
 }
 
 type CtxKeyConfig struct{}
+type CtxKeyMetrics struct{}
 
 var ctxKeyConfig CtxKeyConfig
+var ctxKeyMetrics CtxKeyMetrics
+
+func NewProxyServer(cfg *BuffyConfig) (*ProxyServer, error) {
+	state, err := NewStateStore(cfg.StateFilename())
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := NewCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-func ListenAndServe(cfg *BuffyConfig) (*ProxyServer, error) {
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	ctx = context.WithValue(ctx, ctxKeyConfig, cfg)
 
+	metrics := NewMetrics()
+	ctx = context.WithValue(ctx, ctxKeyMetrics, metrics)
+	ctx = context.WithValue(ctx, ctxKeyState, state)
+	ctx = context.WithValue(ctx, ctxKeyCluster, cluster)
+
+	inflight := newInflightLimit(cfg.Server.MaxInflight)
+	ctx = context.WithValue(ctx, ctxKeyInflight, inflight)
+
 	ps := &ProxyServer{
 		Cfg:            cfg,
+		metrics:        metrics,
+		state:          state,
+		cluster:        cluster,
+		inflight:       inflight,
 		ServerBindAddr: cfg.ServerListenHostPort(),
 		AdminBindAddr:  cfg.AdminListenHostPort(),
 		ctx:            ctx,
 		ctxCancel:      ctxCancel,
-		mux:            &http.ServeMux{},
+	}
+
+	cluster.ps = ps
+	ps.restoreOverrides()
+
+	return ps, nil
+}
+
+func ListenAndServe(cfg *BuffyConfig) (*ProxyServer, error) {
+	ps, err := NewProxyServer(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := ps.RunNotifier(); err != nil {
@@ -81,6 +131,10 @@ func ListenAndServe(cfg *BuffyConfig) (*ProxyServer, error) {
 		return nil, err
 	}
 
+	ps.state.Run(ps.ctx, ps.snapshotState)
+	ps.state.Touch()
+	ps.cluster.Run(ps.ctx)
+
 	return ps, nil
 }
 
@@ -95,11 +149,9 @@ func (ps *ProxyServer) RunServer() error {
 		return err
 	}
 
-	ps.mux.HandleFunc("/", ps.ProxyHandle)
-
 	srv := &http.Server{
 		Addr:    ps.ServerBindAddr,
-		Handler: ps.mux,
+		Handler: http.HandlerFunc(ps.ServeProxy),
 	}
 
 	go func() {
@@ -122,14 +174,14 @@ func (ps *ProxyServer) RunServer() error {
 }
 
 func (ps *ProxyServer) RunAdmin() error {
-	mux := http.NewServeMux()
-	mux.HandleFunc(ps.Cfg.Server.Admin.Path+"/config", ps.AdminHandleConfig)
-	mux.HandleFunc(ps.Cfg.Server.Admin.Path+"/status", ps.AdminHandleStatus)
-	mux.HandleFunc(ps.Cfg.Server.Admin.Path+"/gate", ps.AdminHandleGate)
+	router, err := ps.newAdminRouter()
+	if err != nil {
+		return err
+	}
 
 	srv := &http.Server{
 		Addr:    ps.AdminBindAddr,
-		Handler: mux,
+		Handler: router,
 	}
 
 	go func() {
@@ -151,14 +203,53 @@ func (ps *ProxyServer) RunAdmin() error {
 	return nil
 }
 
+func (ps *ProxyServer) newAdminRouter() (*AdminRouter, error) {
+	guard, err := newAdminGuard(&ps.Cfg.Server.Admin.Auth)
+	if err != nil {
+		return nil, err
+	}
+	guard.peerToken = ps.Cfg.Server.Cluster.Token
+
+	router := NewAdminRouter(ps.Cfg.Server.Admin.Path, guard)
+	ps.registerAdminRoutes(router)
+
+	return router, nil
+}
+
 func (ps *ProxyServer) RunNotifier() error {
 	ps.notifyManager = NewNotifyManager(ps.ctx, &ps.Cfg.Server.Admin.Notify)
 	ps.notifyC = ps.notifyManager.C
 	return nil
 }
 
-func (ps *ProxyServer) ProxyHandle(w http.ResponseWriter, r *http.Request) {
+// ServeProxy dispatches a request through the current endpoint mux, which is
+// rebuilt whenever endpoints change at runtime.
+func (ps *ProxyServer) ServeProxy(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	mux := ps.mux
+	ps.Unlock()
+
+	mux.ServeHTTP(w, r)
+}
+
+// rebuildMux registers every endpoint on a fresh mux. The caller must hold
+// the lock.
+func (ps *ProxyServer) rebuildMux() {
+	mux := http.NewServeMux()
 	for _, e := range ps.endpoints {
+		mux.HandleFunc(e.Path, e.Handler.handler)
+	}
+	mux.HandleFunc("/", ps.ProxyHandle)
+
+	ps.mux = mux
+}
+
+func (ps *ProxyServer) ProxyHandle(w http.ResponseWriter, r *http.Request) {
+	ps.Lock()
+	endpoints := ps.endpoints
+	ps.Unlock()
+
+	for _, e := range endpoints {
 		if strings.Contains(r.URL.Path, e.Path) {
 			log.Printf("[serveEndpoints] endpoint=%s e.Path=%s request URL=[%s]\n", e.Id, e.Path, r.URL.Path)
 			e.Handler.handler(w, r)
@@ -196,23 +287,44 @@ func (ps *ProxyServer) LookupUpstreamWithIds(ids []string) (*Upstream, error) {
 	return nil, errors.New("not found upstream with id: " + ids[0])
 }
 
+// LookupUpstreams returns the upstreams with the given ids, in order.
+func (ps *ProxyServer) LookupUpstreams(ids []string) ([]*Upstream, error) {
+	return findUpstreams(ps.upstreams, ids)
+}
+
+// findUpstreams returns the upstreams of a list with the given ids, in
+// order.
+func findUpstreams(upstreams []*Upstream, ids []string) ([]*Upstream, error) {
+	var ups []*Upstream
+	for _, id := range ids {
+		var found *Upstream
+		for _, u := range upstreams {
+			if u.Def.Id == id {
+				found = u
+			}
+		}
+		if found == nil {
+			return nil, errors.New("not found upstream with id: " + id)
+		}
+		ups = append(ups, found)
+	}
+	return ups, nil
+}
+
 func (ps *ProxyServer) RegisterEndpoints() error {
+	ps.Lock()
+	defer ps.Unlock()
+
 	for _, epdef := range ps.Cfg.Endpoints {
-		endp, err := NewEndpoint(ps.ctx, epdef, ps.notifyC)
+		endp, err := ps.newEndpoint(epdef, ps.upstreams)
 		if err != nil {
 			return err
 		}
 		ps.endpoints = append(ps.endpoints, endp)
+	}
 
-		upstream, err := ps.LookupUpstreamWithIds(epdef.Upstream)
-		if err != nil {
-			return err
-		}
+	ps.rebuildMux()
 
-		if err := endp.Handler.RegisterRoute(ps.mux, upstream); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
@@ -234,3 +346,8 @@ func (ps *ProxyServer) Wait() {
 	time.Sleep(2 * time.Second)
 	log.Printf("Bye...\n")
 }
+
+func metricsFromContext(ctx context.Context) *Metrics {
+	m, _ := ctx.Value(ctxKeyMetrics).(*Metrics)
+	return m
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StateVersion      = 1
+	StateSaveDebounce = 100 * time.Millisecond
+)
+
+// State is what survives a restart: the gate of every upstream and the
+// upstreams and endpoints changed at runtime but not persisted to the
+// config file.
+type State struct {
+	Version   int                   `json:"version"`
+	SavedAt   time.Time             `json:"saved_at"`
+	Gates     map[string]GateRecord `json:"gates"`
+	Overrides *StateOverrides       `json:"overrides,omitempty"`
+}
+
+type GateRecord struct {
+	GateChange
+	Previous string `json:"previous"`
+}
+
+type StateOverrides struct {
+	Upstreams []UpstreamDef `json:"upstreams"`
+	Endpoints []EndpointDef `json:"endpoints"`
+}
+
+// StateStore loads the state file on startup and saves it in the
+// background whenever it is touched. A store without a filename does
+// nothing.
+type StateStore struct {
+	filename string
+	loaded   *State
+	snapshot func() *State
+	touchC   chan struct{}
+
+	sync.Mutex
+}
+
+type CtxKeyState struct{}
+
+var ctxKeyState CtxKeyState
+
+func stateFromContext(ctx context.Context) *StateStore {
+	s, _ := ctx.Value(ctxKeyState).(*StateStore)
+	return s
+}
+
+func NewStateStore(filename string) (*StateStore, error) {
+	s := &StateStore{
+		filename: filename,
+		touchC:   make(chan struct{}, 1),
+	}
+
+	if filename == "" {
+		return s, nil
+	}
+
+	bs, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var st State
+	if err := json.Unmarshal(bs, &st); err != nil {
+		return nil, err
+	}
+	s.loaded = &st
+
+	log.Printf("[state] loaded %s (saved at %s)\n", filename, st.SavedAt.Format(time.RFC3339))
+
+	return s, nil
+}
+
+// Loaded returns the state read on startup, or nil.
+func (s *StateStore) Loaded() *State {
+	if s == nil {
+		return nil
+	}
+	return s.loaded
+}
+
+// TakeGate returns the saved gate of an upstream, only once, so that
+// upstreams created later at runtime start fresh.
+func (s *StateStore) TakeGate(id string) (GateRecord, bool) {
+	if s == nil || s.loaded == nil {
+		return GateRecord{}, false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	g, ok := s.loaded.Gates[id]
+	delete(s.loaded.Gates, id)
+	return g, ok
+}
+
+// Touch schedules a save.
+func (s *StateStore) Touch() {
+	if s == nil || s.filename == "" {
+		return
+	}
+
+	select {
+	case s.touchC <- struct{}{}:
+	default:
+	}
+}
+
+// Run saves the state after every touch, and once more on shutdown.
+func (s *StateStore) Run(ctx context.Context, snapshot func() *State) {
+	if s.filename == "" {
+		return
+	}
+	s.snapshot = snapshot
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				s.save()
+				return
+			case <-s.touchC:
+				time.Sleep(StateSaveDebounce)
+				s.save()
+			}
+		}
+	}()
+}
+
+func (s *StateStore) save() {
+	st := s.snapshot()
+	st.Version = StateVersion
+	st.SavedAt = time.Now()
+
+	bs, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		log.Printf("[state] marshal: err=%s\n", err)
+		return
+	}
+
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		log.Printf("[state] write: err=%s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		log.Printf("[state] rename: err=%s\n", err)
+	}
+}
+
+// StateFilename resolves `state_file` relative to the config file.
+func (cfg *BuffyConfig) StateFilename() string {
+	f := cfg.Server.StateFile
+	if f == "" || filepath.IsAbs(f) {
+		return f
+	}
+	return filepath.Join(cfg.BasePath, f)
+}
+
+func gateValue(name string) uint32 {
+	if name == "closed" {
+		return GateClosed
+	}
+	return GateOpened
+}
+
+// snapshotState captures the gates and runtime overrides.
+func (ps *ProxyServer) snapshotState() *State {
+	ps.Lock()
+	defer ps.Unlock()
+
+	st := &State{Gates: make(map[string]GateRecord)}
+	for _, u := range ps.upstreams {
+		st.Gates[u.Id] = u.Handler.gateRecord()
+	}
+
+	if ps.overridden {
+		st.Overrides = &StateOverrides{
+			Upstreams: ps.Cfg.Upstreams,
+			Endpoints: ps.Cfg.Endpoints,
+		}
+	}
+
+	return st
+}
+
+// restoreOverrides applies the upstreams and endpoints changed at runtime
+// before the last shutdown. An override that no longer validates is
+// dropped in favor of the config file.
+func (ps *ProxyServer) restoreOverrides() {
+	st := ps.state.Loaded()
+	if st == nil || st.Overrides == nil {
+		return
+	}
+
+	cfg := ps.Cfg.Clone()
+	cfg.Upstreams = st.Overrides.Upstreams
+	cfg.Endpoints = st.Overrides.Endpoints
+	if err := cfg.Validate(); err != nil {
+		log.Printf("[state] ignore runtime overrides: err=%s\n", err)
+		return
+	}
+
+	ps.Cfg.Upstreams = cfg.Upstreams
+	ps.Cfg.Endpoints = cfg.Endpoints
+	ps.overridden = true
+
+	log.Printf("[state] restored runtime overrides: %d upstreams, %d endpoints\n", len(cfg.Upstreams), len(cfg.Endpoints))
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRestore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+
+	start := func() *ProxyServer {
+		cfg, err := ReadConfigFile("../examples/buffy.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Server.StateFile = filename
+
+		ps, err := NewProxyServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(ps.ctxCancel)
+
+		if err := ps.RunNotifier(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.CreateUpstreamHandlers(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ps.RegisterEndpoints(); err != nil {
+			t.Fatal(err)
+		}
+		ps.state.snapshot = ps.snapshotState
+
+		return ps
+	}
+
+	ps := start()
+	ps.lookupUpstream("service1").Closegate("admin:ci", "deploy", time.Hour)
+	ps.lookupUpstream("service2").Closegate("admin:ci", "expired", time.Millisecond)
+	if code, err := ps.AddUpstream(UpstreamDef{Id: "preview", Endpoint: "http://localhost:9093"}); err != nil {
+		t.Fatal(code, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	ps.state.save()
+	ps.ctxCancel()
+
+	ps = start()
+
+	u := ps.lookupUpstream("service1")
+	if u == nil || u.Handler.GetGateState() != GateClosed {
+		t.Fatal("service1 gate not restored")
+	}
+	if info := u.Handler.GateInfo(); info.Actor != "admin:ci" || info.Reason != "deploy" || info.ExpiresAt == nil {
+		t.Errorf("unexpected gate record: %+v", info)
+	}
+
+	if u := ps.lookupUpstream("service2"); u.Handler.GetGateState() != GateOpened {
+		t.Error("service2 gate should have reverted")
+	}
+
+	if ps.lookupUpstream("preview") == nil {
+		t.Error("runtime upstream not restored")
+	}
+}
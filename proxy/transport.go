@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,7 +11,10 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,12 +33,10 @@ var proxyTransport = http.Transport{
 }
 
 type MyTransport struct {
-	upstream          string
-	mode              string
-	timeout           int
-	interval          int
-	getUpstreamStatus func() uint32
-	getGateState      func() uint32
+	upstream string
+	interval time.Duration
+	notify   func(string)
+	metrics  *Metrics
 }
 
 func (t *MyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -44,68 +46,260 @@ func (t *MyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
 	retries := 0
 	st := time.Now()
 
-	switch t.mode {
-	case ProxyModeStoreAndForward:
-		// TODO: handle this
-	case ProxyModeBypass:
+	id := request.Header.Get(HeaderRequestID)
+	waited := false
+
+	interval := t.interval
+	if interval == 0 {
+		interval = DefaultIntervalPing
 	}
 
-	var interval time.Duration
+	// the queue of the endpoint orders the requests held for the upstream
+	eh := endpointFromContext(request.Context())
+	if eh == nil || eh.queue == nil {
+		return nil, errors.New("buffy: request without endpoint queue")
+	}
+	endpoint := eh.def.Id
+	queue := eh.queue
+	timeout := queue.timeout
+	// without a timeout, requests are held until their client leaves
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = st.Add(timeout)
+	}
+	if d, ok := request.Context().Deadline(); ok && !before(deadline, d) {
+		deadline = d
+	}
 
-	if t.interval == 0 {
-		interval = DefaultIntervalPing
-	} else {
-		interval = time.Duration(t.interval) * time.Millisecond
+	// answered from the cache when fresh, or stale while no upstream can
+	// take it; otherwise revalidated if possible
+	cached := eh.cache.get(request)
+	if eh.cache != nil {
+		state := ""
+		if cached != nil && cached.fresh(st) && !noCache(request) {
+			state = CacheHit
+		} else if cached != nil && eh.def.Cache.ServeStaleWhenGated && !queue.ready() {
+			state = CacheStale
+		}
+		if state != "" {
+			t.metrics.Inc(MetricCacheRequestsTotal, endpoint, state)
+			response = cached.response(request, state)
+			response.Header.Add("X-Buffy-Elasped", fmt.Sprintf("%.5f sec", time.Since(st).Seconds()))
+			response.Header.Set(HeaderRequestID, id)
+			return response, nil
+		}
+		if cached != nil && !cached.validated() {
+			cached = nil
+		}
+	}
+	conditional := request.Header.Get("If-None-Match") != "" || request.Header.Get("If-Modified-Since") != ""
+	cacheKey := ""
+	if eh.cache != nil && (request.Method == http.MethodGet || request.Method == http.MethodHead) {
+		cacheKey = eh.cache.key(request)
+	}
+
+	// identical requests in flight share the response of the first one,
+	// or go on their own when it cannot be shared
+	if key := eh.coalescer.key(request); key != "" {
+		call, leader := eh.coalescer.join(key)
+		if leader {
+			defer func() { eh.coalescer.finish(key, call, response) }()
+		} else {
+			select {
+			case <-call.done:
+			case <-request.Context().Done():
+				t.abandoned(endpoint, id, time.Since(st), false)
+				return nil, request.Context().Err()
+			}
+			if call.shared {
+				t.metrics.Inc(MetricCoalescedTotal, endpoint)
+				response = call.response(request)
+				response.Header.Set("X-Buffy-Elasped", fmt.Sprintf("%.5f sec", time.Since(st).Seconds()))
+				response.Header.Set(HeaderRequestID, id)
+				return response, nil
+			}
+		}
 	}
 
+	// every attempt sends the body from the start; a bypass request is
+	// only buffered when it may be retried
+	retry := &eh.def.Retry
+	replay := retry.enabled() || eh.def.ProxyMode == ProxyModeStoreAndForward
+	if replay {
+		if err := replayable(request); err != nil {
+			return nil, err
+		}
+	}
+
+	// the reverse proxy targets the first upstream; the others take the
+	// same path below their endpoint
+	path := strings.TrimPrefix(request.URL.Path, strings.TrimSuffix(eh.upstream.url.Path, "/"))
+
+	attempts := 0
+	lane := DefaultLane
+	used := ""
+	var member *Upstream
+	var done func()
 	for {
-		if t.getGateState() == GateOpened {
-			if t.getUpstreamStatus() == StatusAvailable {
-				log.Printf("[MyTransport/RoundTrip/%d] upstream is available!\n", retries)
+		// the endpoint may have been updated at runtime meanwhile
+		cur := eh.current()
+		if cur.queue != nil {
+			queue = cur.queue
+		}
 
-				response, err = proxyTransport.RoundTrip(request)
-				if err == nil {
-					break
-				}
+		// a fallback takes the request at once while no upstream can
+		if fb := cur.fallbackFor(request); fb.take(queue) {
+			lane, _ = queue.classify(request)
+			used = fb.def.Upstream + fb.def.Response
+			t.metrics.Inc(MetricFallbacksTotal, endpoint, used)
 
-				log.Printf("[MyTransport/RoundTrip/%d] err=%v\n", retries, err)
-
-				// broken (upstream shutdown)
-				if errors.Is(err, io.EOF) {
-					r := ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("Error: EOF upstream broken"))))
-					response = &http.Response{
-						Request:    request,
-						Header:     http.Header{},
-						StatusCode: http.StatusServiceUnavailable,
-						Status:     http.StatusText(http.StatusServiceUnavailable),
-						Body:       r,
-					}
-					err = nil
-					break
-				}
+			if fb.upstream == nil {
+				response = eh.newResponse(request, fb.def.Response, nil)
+				break
+			}
+			member, err = fb.upstream, nil
+		} else {
+			lane, member, err = queue.Wait(request, deadline)
+		}
+		m := member
+		done = func() { queue.done(m) }
+
+		// the client left
+		if err == ErrQueueAbandoned {
+			t.abandoned(endpoint, id, time.Since(st), false)
+			return nil, request.Context().Err()
+		}
 
-				if errors.Is(err, context.Canceled) {
-					break
+		// taken out of the queue through the admin API
+		if f, ok := err.(*queueFlushed); ok {
+			response = eh.newResponse(request, f.response, nil)
+			err = nil
+			break
+		}
+
+		// waiting timeout
+		if err == ErrQueueTimeout {
+			t.metrics.Inc(MetricTimeoutsTotal, endpoint, t.upstream)
+			if !waited {
+				t.metrics.Observe(MetricQueueWait, time.Since(st).Seconds(), endpoint, t.upstream)
+			}
+
+			name := NameHitTimeout
+			if !queue.gateOpened() {
+				name = NameGateClosed
+			}
+			response = eh.newResponse(request, name, map[string]string{"ELAPSED": formatSeconds(time.Since(st))})
+			err = nil
+			break
+		}
+
+		log.Printf("[MyTransport/RoundTrip/%d] upstream %s is available! lane=%s id=%s\n", retries, member.Id, lane, id)
+
+		if !waited {
+			t.metrics.Observe(MetricQueueWait, time.Since(st).Seconds(), endpoint, t.upstream)
+			waited = true
+		}
+
+		if attempts > 0 {
+			rewind(request)
+		}
+		attempts++
+		retarget(request, member.url, path)
+		if cached != nil && !conditional {
+			if etag := cached.Header.Get("ETag"); etag != "" {
+				request.Header.Set("If-None-Match", etag)
+			} else {
+				request.Header.Set("If-Modified-Since", cached.Header.Get("Last-Modified"))
+			}
+		}
+
+		// the queue took an in-flight slot on release, freed by done
+		sent := time.Now()
+		response, err = eh.transport.RoundTrip(request)
+		if !errors.Is(err, context.Canceled) {
+			failed := err != nil || response.StatusCode >= 500
+			member.Handler.observe(failed)
+			queue.outlier.observe(member.Id, failed, time.Since(sent), time.Now())
+		}
+		if err == nil {
+			if attempts < retry.Attempts && retry.onStatus(response.StatusCode) && retry.allows(request) {
+				backoff := retry.backoff(attempts, interval)
+				if before(time.Now().Add(backoff), deadline) {
+					log.Printf("[MyTransport/RoundTrip/%d] status=%d, retry in %s id=%s\n", retries, response.StatusCode, backoff, id)
+					io.CopyN(ioutil.Discard, response.Body, 4096)
+					response.Body.Close()
+					done()
+
+					t.retry(request, endpoint, backoff)
+					retries++
+					continue
 				}
 			}
+
+			// the cached response is still valid
+			if cached != nil && !conditional && response.StatusCode == http.StatusNotModified {
+				response.Body.Close()
+				done()
+
+				request.Header.Del("If-None-Match")
+				request.Header.Del("If-Modified-Since")
+				cached = eh.cache.refresh(cached, request, response)
+				t.metrics.Inc(MetricCacheRequestsTotal, endpoint, CacheRevalidated)
+				response = cached.response(request, CacheRevalidated)
+				break
+			}
+			if cacheKey != "" {
+				t.metrics.Inc(MetricCacheRequestsTotal, endpoint, CacheMiss)
+				eh.cache.store(cacheKey, request, response)
+			}
+
+			response.Body = &inflightBody{ReadCloser: response.Body, done: done}
+			if c := clientFromContext(request.Context()); c != nil && c.Err() != nil {
+				t.abandoned(endpoint, id, time.Since(st), true)
+			}
+			break
 		}
+		done()
 
-		// waiting timeout
-		if time.Since(st).Seconds() >= float64(t.timeout) {
-			r := ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("Error: timeout %d sec", t.timeout))))
-			response = &http.Response{
-				Request:    request,
-				Header:     http.Header{},
-				StatusCode: http.StatusServiceUnavailable,
-				Status:     http.StatusText(http.StatusServiceUnavailable),
-				Body:       r,
+		log.Printf("[MyTransport/RoundTrip/%d] err=%v id=%s\n", retries, err, id)
+
+		if errors.Is(err, context.Canceled) {
+			break
+		}
+
+		// without a policy, a request that did not reach the upstream goes
+		// back to the queue until its timeout, as long as its body is intact
+		if request.Context().Err() != nil {
+			// past the total timeout
+		} else if retry.enabled() {
+			if attempts < retry.Attempts && (connectError(err) || retry.allows(request)) {
+				backoff := retry.backoff(attempts, interval)
+				if before(time.Now().Add(backoff), deadline) {
+					t.retry(request, endpoint, backoff)
+					retries++
+					continue
+				}
 			}
+		} else if connectError(err) && (replay || request.Body == nil || request.Body == http.NoBody) {
+			t.retry(request, endpoint, interval)
+			retries++
+			continue
+		}
+
+		// connect, response header or total timeout
+		var ne net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+			t.metrics.Inc(MetricTimeoutsTotal, endpoint, t.upstream)
+			response = eh.newResponse(request, NameHitTimeout, map[string]string{"ELAPSED": formatSeconds(time.Since(st)), "ERROR": err.Error()})
 			err = nil
 			break
 		}
 
-		time.Sleep(interval)
-		retries++
+		// broken (upstream shutdown); the request may have reached the
+		// upstream, so it is not sent again
+		response = eh.newResponse(request, NameUpstreamBroken, map[string]string{"ERROR": err.Error()})
+		err = nil
+		break
 	}
 
 	// TODO: create fake response
@@ -123,15 +317,146 @@ func (t *MyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
 	// not disconnected
 	// if !errors.Is(err, context.Canceled) && !errors.Is(err, io.EOF) {
 	if response != nil {
+		response.Header.Set(HeaderRequestID, id)
 		response.Header.Add("X-Buffy-Elasped", fmt.Sprintf("%.5f sec", time.Since(st).Seconds()))
-		response.Header.Add("X-Buffy-Timeout", strconv.Itoa(t.timeout))
-		response.Header.Add("X-Buffy-Mode", t.mode)
-		response.Header.Add("X-Buffy-Upstream", t.upstream)
+		response.Header.Add("X-Buffy-Timeout", formatSeconds(timeout))
+		addTimeoutHeader(response.Header, "Connect", eh.def.Timeouts.Connect)
+		addTimeoutHeader(response.Header, "Response-Header", eh.def.Timeouts.ResponseHeader)
+		addTimeoutHeader(response.Header, "Total", eh.def.Timeouts.Total)
+		response.Header.Add("X-Buffy-Lane", lane)
+		response.Header.Add("X-Buffy-Attempts", strconv.Itoa(attempts))
+		response.Header.Add("X-Buffy-Mode", eh.def.ProxyMode)
+		upstream := t.upstream
+		if member != nil {
+			upstream = member.Id
+		}
+		response.Header.Add("X-Buffy-Upstream", upstream)
+		if used != "" {
+			response.Header.Add("X-Buffy-Fallback", used)
+		}
 	}
 
 	return response, err
 }
 
+// before reports whether t comes before a deadline, the zero one being
+// none.
+func before(t, deadline time.Time) bool {
+	return deadline.IsZero() || t.Before(deadline)
+}
+
+// retarget points a request at an upstream, below its endpoint.
+func retarget(r *http.Request, target *url.URL, path string) {
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = strings.TrimSuffix(target.Path, "/") + path
+	r.URL.RawPath = ""
+}
+
+// newEndpointTransport returns the shared transport, or a copy with the
+// connect and response header timeouts of an endpoint.
+func newEndpointTransport(ts *TimeoutsDef) http.RoundTripper {
+	if ts.Connect == 0 && ts.ResponseHeader == 0 {
+		return &proxyTransport
+	}
+
+	tr := proxyTransport.Clone()
+	if ts.Connect > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(ts.Connect),
+			KeepAlive: 200 * time.Second,
+		}).DialContext
+	}
+	tr.ResponseHeaderTimeout = time.Duration(ts.ResponseHeader)
+
+	return tr
+}
+
+func addTimeoutHeader(h http.Header, name string, d Duration) {
+	if d > 0 {
+		h.Add("X-Buffy-Timeout-"+name, formatSeconds(time.Duration(d)))
+	}
+}
+
+// retry pauses before a request goes back to the queue for another
+// attempt. The queue notices if the client leaves meanwhile.
+func (t *MyTransport) retry(r *http.Request, endpoint string, backoff time.Duration) {
+	t.metrics.Inc(MetricRetriesTotal, endpoint, t.upstream)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// abandoned records a request whose client left while it was held. A
+// delivered request was sent upstream anyway (`deliver_abandoned`).
+func (t *MyTransport) abandoned(endpoint, id string, waited time.Duration, delivered bool) {
+	t.metrics.Inc(MetricAbandonedTotal, endpoint, t.upstream, strconv.FormatBool(delivered))
+
+	bs, _ := json.Marshal(map[string]interface{}{
+		"status":     "abandoned",
+		"endpoint":   endpoint,
+		"upstream":   t.upstream,
+		"request_id": id,
+		"waited":     waited.Seconds(),
+		"delivered":  delivered,
+	})
+	t.notify(string(bs))
+}
+
+// detachedContext keeps the values of a request context but not its
+// cancellation, so that a stored request is delivered after its client
+// left.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+type CtxKeyClient struct{}
+
+var ctxKeyClient CtxKeyClient
+
+// clientFromContext returns the original context of a detached request.
+func clientFromContext(ctx context.Context) context.Context {
+	c, _ := ctx.Value(ctxKeyClient).(context.Context)
+	return c
+}
+
+// detach stores the body of a request and lets it outlive its client.
+func detach(r *http.Request) (*http.Request, error) {
+	if r.Body != nil && r.Body != http.NoBody {
+		body, stored, err := drainBody(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body.Close()
+		r.Body = stored
+	}
+
+	ctx := context.WithValue(detachedContext{r.Context()}, ctxKeyClient, r.Context())
+	return r.WithContext(ctx), nil
+}
+
+// inflightBody releases the in-flight slot of an upstream once the
+// response has been copied to the client.
+type inflightBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *inflightBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
 func drainBody(b io.ReadCloser) (r1, r2 io.ReadCloser, err error) {
 	var buf bytes.Buffer
 	if _, err = buf.ReadFrom(b); err != nil {
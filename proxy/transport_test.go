@@ -0,0 +1,497 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy adds an upstream served by h and a proxy endpoint on /held
+// to a test server, after the other upstreams given. The upstream is
+// available and its gate closed.
+func newTestProxy(t *testing.T, h http.HandlerFunc, ep EndpointDef, others ...UpstreamDef) (*ProxyServer, *Upstream) {
+	ps, _ := newTestAdmin(t)
+
+	for _, def := range others {
+		if _, err := ps.AddUpstream(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	if _, err := ps.AddUpstream(UpstreamDef{Id: "held", Endpoint: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	up := ps.lookupUpstream("held")
+	up.Handler.UpdateUpstreamStatus(StatusAvailable)
+	up.Closegate("admin:test", "hold", 0)
+
+	ep.Id, ep.Path, ep.Type, ep.Upstream = "held", "/held", TypeProxy, []string{"held"}
+	if ep.ProxyMode == "" {
+		ep.ProxyMode = ProxyModeBypass
+	}
+	if _, err := ps.AddEndpoint(ep); err != nil {
+		t.Fatal(err)
+	}
+
+	return ps, up
+}
+
+func TestTransportAbandoned(t *testing.T) {
+	received := make(chan string, 1)
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- string(bs)
+	}, EndpointDef{Timeout: Duration(10 * time.Second), MaxQueue: 10})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/held", strings.NewReader("order")).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	st := time.Now()
+	ps.ServeProxy(httptest.NewRecorder(), r)
+	if time.Since(st) > 5*time.Second {
+		t.Fatal("kept waiting after the client left")
+	}
+
+	if v := ps.metrics.Value(MetricAbandonedTotal, "held", "held", "false"); v != 1 {
+		t.Errorf("abandoned: got %v", v)
+	}
+	if e := ps.lookupEndpoint("held"); e.Handler.QueueDepth() != 0 {
+		t.Error("abandoned request still held")
+	}
+
+	up.Opengate("admin:test", "", 0)
+	select {
+	case body := <-received:
+		t.Errorf("abandoned request delivered: %q", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTransportDeliverAbandoned(t *testing.T) {
+	received := make(chan string, 1)
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		received <- string(bs)
+	}, EndpointDef{Timeout: Duration(10 * time.Second), MaxQueue: 10, ProxyMode: ProxyModeStoreAndForward, DeliverAbandoned: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/held", strings.NewReader("order")).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		ps.ServeProxy(httptest.NewRecorder(), r)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	up.Opengate("admin:test", "", 0)
+
+	select {
+	case body := <-received:
+		if body != "order" {
+			t.Errorf("got body %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned request not delivered")
+	}
+	<-done
+
+	if v := ps.metrics.Value(MetricAbandonedTotal, "held", "held", "true"); v != 1 {
+		t.Errorf("abandoned: got %v", v)
+	}
+}
+
+func TestTransportTotalTimeout(t *testing.T) {
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}, EndpointDef{
+		Timeout:  Duration(10 * time.Second),
+		Timeouts: TimeoutsDef{Total: Duration(200 * time.Millisecond)},
+		MaxQueue: 10,
+	})
+	up.Opengate("admin:test", "", 0)
+
+	st := time.Now()
+	w := httptest.NewRecorder()
+	ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/held", nil))
+	if time.Since(st) > 900*time.Millisecond {
+		t.Fatal("total timeout not applied")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Buffy-Timeout-Total"); got != "0.2" {
+		t.Errorf("X-Buffy-Timeout-Total: got %q", got)
+	}
+}
+
+func TestTransportRetry(t *testing.T) {
+	var bodies []string
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(bs))
+		if len(bodies)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}, EndpointDef{
+		Timeout:  Duration(10 * time.Second),
+		MaxQueue: 10,
+		Retry:    RetryDef{Attempts: 3, Backoff: Duration(time.Millisecond), OnStatus: []int{503}},
+	})
+	up.Opengate("admin:test", "", 0)
+
+	send := func(method string, key bool) *httptest.ResponseRecorder {
+		bodies = nil
+		r := httptest.NewRequest(method, "/held", strings.NewReader("order"))
+		if key {
+			r.Header.Set("Idempotency-Key", "1")
+		}
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, r)
+		return w
+	}
+
+	// the body is replayed on each attempt
+	if w := send(http.MethodPut, false); w.Code != http.StatusOK || w.Header().Get("X-Buffy-Attempts") != "3" {
+		t.Errorf("put: got %d after %s attempts", w.Code, w.Header().Get("X-Buffy-Attempts"))
+	}
+	if strings.Join(bodies, ",") != "order,order,order" {
+		t.Errorf("put: upstream got %q", bodies)
+	}
+
+	if w := send(http.MethodPost, false); w.Code != http.StatusServiceUnavailable || len(bodies) != 1 {
+		t.Errorf("post: got %d after %d attempts", w.Code, len(bodies))
+	}
+
+	if w := send(http.MethodPost, true); w.Code != http.StatusOK || len(bodies) != 3 {
+		t.Errorf("post with key: got %d after %d attempts", w.Code, len(bodies))
+	}
+
+	if v := ps.metrics.Value(MetricRetriesTotal, "held", "held"); v != 4 {
+		t.Errorf("retries: got %v", v)
+	}
+}
+
+func TestTransportMembers(t *testing.T) {
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("held " + r.URL.Path))
+	}, EndpointDef{Timeout: Duration(10 * time.Second), MaxQueue: 10})
+	up.Opengate("admin:test", "", 0)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other " + r.URL.Path))
+	}))
+	t.Cleanup(srv.Close)
+	if _, err := ps.AddUpstream(UpstreamDef{Id: "other", Endpoint: srv.URL + "/v2/"}); err != nil {
+		t.Fatal(err)
+	}
+	ps.lookupUpstream("other").Handler.UpdateUpstreamStatus(StatusAvailable)
+
+	if _, err := ps.AddEndpoint(EndpointDef{
+		Id: "both", Path: "/both", Type: TypeProxy, ProxyMode: ProxyModeBypass,
+		Upstream: []string{"held", "other"}, Timeout: Duration(10 * time.Second), MaxQueue: 10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/both/x", nil))
+		got = append(got, w.Header().Get("X-Buffy-Upstream")+": "+w.Body.String())
+	}
+	if strings.Join(got, ", ") != "held: held /both/x, other: other /v2/both/x, held: held /both/x" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTransportProxyModePerEndpoint(t *testing.T) {
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}, EndpointDef{Timeout: Duration(10 * time.Second)})
+	up.Opengate("admin:test", "go", 0)
+
+	// registered last on the same upstream
+	if _, err := ps.AddEndpoint(EndpointDef{
+		Id: "saf", Path: "/saf", Type: TypeProxy, ProxyMode: ProxyModeStoreAndForward,
+		Upstream: []string{"held"}, Timeout: Duration(10 * time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, mode := range map[string]string{"/held": ProxyModeBypass, "/saf": ProxyModeStoreAndForward} {
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("X-Buffy-Mode"); w.Code != http.StatusOK || got != mode {
+			t.Errorf("%s: got %d %q, want %q", path, w.Code, got, mode)
+		}
+	}
+}
+
+func TestTransportNoTimeout(t *testing.T) {
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}, EndpointDef{})
+	up.Opengate("admin:test", "go", 0)
+
+	w := httptest.NewRecorder()
+	ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/held", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "upstream" {
+		t.Errorf("open gate: got %d %q", w.Code, w.Body.String())
+	}
+
+	// held until the client leaves
+	up.Closegate("admin:test", "hold", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	ps.ServeProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/held", nil).WithContext(ctx))
+	if d := time.Since(st); d < 100*time.Millisecond {
+		t.Errorf("closed gate: answered after %s", d)
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("replica"))
+	}))
+	t.Cleanup(replica.Close)
+
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	}, EndpointDef{
+		Timeout:  Duration(200 * time.Millisecond),
+		MaxQueue: 10,
+		Response: []EndpointResponseDef{{Name: "maintenance", ReturnCode: 503, Content: "maintenance"}},
+		Fallback: []FallbackDef{
+			{Methods: []string{"GET"}, Upstream: "replica"},
+			{Methods: []string{"DELETE"}, Response: "maintenance"},
+		},
+	}, UpstreamDef{Id: "replica", Endpoint: replica.URL})
+	ps.lookupUpstream("replica").Handler.UpdateUpstreamStatus(StatusAvailable)
+
+	send := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, httptest.NewRequest(method, "/held", nil))
+		return w
+	}
+
+	// the gate of the primary is closed
+	st := time.Now()
+	if w := send(http.MethodGet); w.Body.String() != "replica" || w.Header().Get("X-Buffy-Fallback") != "replica" {
+		t.Errorf("get: got %q", w.Body.String())
+	}
+	if w := send(http.MethodDelete); w.Code != 503 || w.Body.String() != "maintenance" {
+		t.Errorf("delete: got %d %q", w.Code, w.Body.String())
+	}
+	if time.Since(st) > 150*time.Millisecond {
+		t.Error("fallbacks waited for the primary")
+	}
+	if w := send(http.MethodPost); w.Code != 503 || w.Header().Get("X-Buffy-Fallback") != "" {
+		t.Errorf("post: got %d %q", w.Code, w.Body.String())
+	}
+
+	up.Opengate("admin:test", "", 0)
+	if w := send(http.MethodGet); w.Body.String() != "primary" {
+		t.Errorf("get with the gate open: got %q", w.Body.String())
+	}
+}
+
+func TestTransportCoalesce(t *testing.T) {
+	var calls int32
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Write([]byte(fmt.Sprintf("call %d %s", n, r.Header.Get("Authorization"))))
+	}, EndpointDef{Timeout: Duration(10 * time.Second), MaxQueue: 10, Coalesce: CoalesceDef{Enabled: true}})
+
+	send := func(auth string) <-chan *httptest.ResponseRecorder {
+		c := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			r := httptest.NewRequest(http.MethodGet, "/held?page=1", nil)
+			if auth != "" {
+				r.Header.Set("Authorization", auth)
+			}
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, r)
+			c <- w
+		}()
+		return c
+	}
+
+	// held behind the closed gate
+	var waiting []<-chan *httptest.ResponseRecorder
+	for i := 0; i < 4; i++ {
+		waiting = append(waiting, send(""))
+	}
+	private := send("alice")
+	time.Sleep(100 * time.Millisecond)
+	up.Opengate("admin:test", "", 0)
+
+	coalesced := 0
+	for _, c := range waiting {
+		w := <-c
+		if w.Body.String() != "call 1 " && w.Body.String() != "call 2 " {
+			t.Errorf("got %q", w.Body.String())
+		}
+		if w.Header().Get("X-Buffy-Coalesced") == "true" {
+			coalesced++
+		}
+	}
+	if w := <-private; w.Body.String() != "call 1 alice" && w.Body.String() != "call 2 alice" {
+		t.Errorf("authorized request: got %q", w.Body.String())
+	}
+	if calls != 2 || coalesced != 3 {
+		t.Errorf("got %d upstream calls, %d coalesced", calls, coalesced)
+	}
+	if v := ps.metrics.Value(MetricCoalescedTotal, "held"); v != 3 {
+		t.Errorf("coalesced metric: got %v", v)
+	}
+
+	c := newCoalescer(&CoalesceDef{Enabled: true})
+	r := httptest.NewRequest(http.MethodGet, "/held?page=2", nil)
+	r.Header.Set("X-Buffy-URL", "/held?page=1")
+	if k := c.key(r); k != "GET /held?page=2" {
+		t.Errorf("key of a client-set X-Buffy-URL: got %q", k)
+	}
+}
+
+func TestTransportMaxInflight(t *testing.T) {
+	var calls int32
+	unblock := make(chan struct{})
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-unblock
+	}, EndpointDef{Timeout: Duration(10 * time.Second), MaxInflight: 1})
+	up.Opengate("admin:test", "", 0)
+
+	finished := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/held", nil))
+			finished <- w.Code
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	e := ps.lookupEndpoint("held")
+	if n := atomic.LoadInt32(&calls); n != 1 || e.Handler.queue.Len() != 1 {
+		t.Errorf("got %d upstream calls, %d waiting", n, e.Handler.queue.Len())
+	}
+
+	// max_queue 0 holds without limit
+	if e.Handler.IsReachedMaxQueue() {
+		t.Error("max_queue 0 rejects requests")
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if code := <-finished; code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+	if n := e.Handler.queue.inflight.Inflight(); n != 0 {
+		t.Errorf("in flight after the requests: %d", n)
+	}
+}
+
+func TestTransportFallbackMaxInflight(t *testing.T) {
+	var calls int32
+	unblock := make(chan struct{})
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-unblock
+	}))
+	t.Cleanup(replica.Close)
+
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {}, EndpointDef{
+		Timeout:     Duration(10 * time.Second),
+		MaxInflight: 1,
+		Fallback:    []FallbackDef{{Methods: []string{"GET"}, Upstream: "replica"}},
+	}, UpstreamDef{Id: "replica", Endpoint: replica.URL})
+	ps.lookupUpstream("replica").Handler.UpdateUpstreamStatus(StatusAvailable)
+
+	finished := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			ps.ServeProxy(w, httptest.NewRequest(http.MethodGet, "/held", nil))
+			finished <- w.Code
+		}()
+	}
+
+	// the fallback holds the only slot of the endpoint
+	time.Sleep(100 * time.Millisecond)
+	e := ps.lookupEndpoint("held")
+	if n := atomic.LoadInt32(&calls); n != 1 || e.Handler.queue.Len() != 1 {
+		t.Errorf("got %d fallback calls, %d waiting", n, e.Handler.queue.Len())
+	}
+
+	close(unblock)
+	up.Opengate("admin:test", "", 0)
+	for i := 0; i < 2; i++ {
+		if code := <-finished; code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+	if n := e.Handler.queue.inflight.Inflight(); n != 0 {
+		t.Errorf("in flight after the requests: %d", n)
+	}
+}
+
+func TestTransportRequestID(t *testing.T) {
+	seen := make(chan string, 2)
+	ps, up := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-ID", "from-upstream")
+	}, EndpointDef{Timeout: Duration(10 * time.Second)})
+	up.Opengate("admin:test", "", 0)
+
+	send := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/held", nil)
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		ps.ServeProxy(w, r)
+		return w
+	}
+
+	w := send("req-42")
+	if got := <-seen; got != "req-42" || w.Header().Values("X-Request-ID")[0] != "req-42" || len(w.Header().Values("X-Request-ID")) != 1 {
+		t.Errorf("given id: upstream got %q, response %q", got, w.Header().Values("X-Request-ID"))
+	}
+
+	w = send("")
+	id := <-seen
+	if len(id) != 36 || w.Header().Get("X-Request-ID") != id {
+		t.Errorf("new id: upstream got %q, response %q", id, w.Header().Get("X-Request-ID"))
+	}
+
+	e := ps.lookupEndpoint("held")
+	if e.Handler.QueueDepth() != 0 || len(e.Handler.Conns) != 0 {
+		t.Errorf("requests still tracked: %v", e.Handler.Conns)
+	}
+
+	// a reused id is tracked apart
+	r := httptest.NewRequest(http.MethodGet, "/held", nil)
+	r.Header.Set("X-Request-ID", "dup")
+	a, b := e.Handler.In(r), e.Handler.In(r)
+	if a != "dup" || b != "dup-2" || r.Header.Get("X-Request-ID") != b || e.Handler.QueueDepth() != 2 {
+		t.Errorf("reused id: got %q and %q, header %q", a, b, r.Header.Get("X-Request-ID"))
+	}
+	e.Handler.Out(a)
+	e.Handler.Out(b)
+}
@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -35,10 +37,13 @@ const (
 )
 
 type UpstreamDef struct {
-	Id       string      `json:"id"       yaml:"id"`
-	Endpoint string      `json:"endpoint" yaml:"endpoint"`
-	Interval int         `json:"interval" yaml:"interval"`
-	Autogate AutogateDef `json:"autogate" yaml:"autogate"`
+	Id        string        `json:"id"        yaml:"id"`
+	Endpoint  string        `json:"endpoint"  yaml:"endpoint"`
+	Interval  Milliseconds  `json:"interval"  yaml:"interval"`
+	Autogate  AutogateDef   `json:"autogate"  yaml:"autogate"`
+	Schedules []ScheduleDef `json:"schedules" yaml:"schedules"`
+	Release   ReleaseDef    `json:"release"   yaml:"release"`
+	Breaker   BreakerDef    `json:"breaker"   yaml:"breaker"`
 }
 
 type AutogateDef struct {
@@ -55,54 +60,197 @@ type MatchDef struct {
 
 type UpstreamHandler struct {
 	ctx      context.Context
+	cancel   context.CancelFunc
 	def      *UpstreamDef
 	revproxy *httputil.ReverseProxy
 	notiC    chan string
 
 	UpstreamStatus uint32 `json:"upstream_status"`
 	GateState      uint32 `json:"gate_state"`
+	InFlight       int32  `json:"in_flight"`
+
+	gate      *GateChange
+	state     *StateStore
+	cluster   *Cluster
+	release   *releaser
+	breaker   *breaker
+	schedules []*schedule
+	windows   map[string]bool
+
+	// closed and replaced whenever the gate, the status or the number of
+	// requests in flight changes, to wake up the queues
+	changed   chan struct{}
+	watchLock sync.Mutex
 
 	sync.Mutex
 }
 
+func (u *UpstreamDef) Validate() error {
+	if u.Id == "" {
+		return errors.New("upstream: missing 'id'")
+	}
+
+	ep, err := url.Parse(u.Endpoint)
+	if err != nil {
+		return fmt.Errorf("upstream %s: invalid endpoint: %s", u.Id, err)
+	}
+	if ep.Scheme == "" || ep.Host == "" {
+		return fmt.Errorf("upstream %s: invalid endpoint: %q", u.Id, u.Endpoint)
+	}
+
+	if u.Interval < 0 {
+		return fmt.Errorf("upstream %s: invalid interval: %s", u.Id, time.Duration(u.Interval))
+	}
+
+	for i := range u.Schedules {
+		if err := u.Schedules[i].Validate(); err != nil {
+			return fmt.Errorf("upstream %s: %s", u.Id, err)
+		}
+	}
+
+	if err := u.Release.Validate(); err != nil {
+		return fmt.Errorf("upstream %s: %s", u.Id, err)
+	}
+
+	if err := u.Breaker.Validate(); err != nil {
+		return fmt.Errorf("upstream %s: %s", u.Id, err)
+	}
+
+	return nil
+}
+
 func NewUpstream(ctx context.Context, u UpstreamDef, notiC chan string) (*Upstream, error) {
+	target, err := url.Parse(u.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
 	up := &Upstream{
 		Id:       u.Id,
 		Endpoint: u.Endpoint,
 		Def:      &u,
+		url:      target,
 		Handler: &UpstreamHandler{
 			ctx:            ctx,
+			cancel:         cancel,
 			notiC:          notiC,
 			def:            &u,
 			UpstreamStatus: StatusNone,
 			GateState:      GateOpened,
+			windows:        make(map[string]bool),
+			state:          stateFromContext(ctx),
+			cluster:        clusterFromContext(ctx),
 		},
 	}
 
+	if u.Release.MaxConcurrent > 0 || u.Release.Rate > 0 {
+		up.Handler.release = newReleaser(&up.Def.Release)
+	}
+
+	if u.Breaker.enabled() {
+		up.Handler.breaker = newBreaker(&up.Def.Breaker)
+	}
+
+	if rec, ok := up.Handler.state.TakeGate(u.Id); ok {
+		log.Printf("[upstream:%s] restore gate %s by %s: %s\n", u.Id, rec.State, rec.Actor, rec.Reason)
+		up.Handler.restoreGate(rec)
+	}
+
+	for i := range up.Def.Schedules {
+		sc, err := newSchedule(&up.Def.Schedules[i])
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		up.Handler.schedules = append(up.Handler.schedules, sc)
+	}
+
 	go up.Handler.run()
 
 	return up, nil
 }
 
-func (us *Upstream) Opengate() error {
-	us.Handler.UpdateGate(GateOpened)
+// Stop ends the health checks of an upstream removed at runtime.
+func (us *Upstream) Stop() {
+	us.Handler.cancel()
+}
+
+func (us *Upstream) Opengate(actor, reason string, ttl time.Duration) error {
+	us.Handler.SetGate(GateOpened, actor, reason, ttl)
 	return nil
 }
 
-func (us *Upstream) Closegate() error {
-	us.Handler.UpdateGate(GateClosed)
+func (us *Upstream) Closegate(actor, reason string, ttl time.Duration) error {
+	us.Handler.SetGate(GateClosed, actor, reason, ttl)
 	return nil
 }
 
+// Transitions lists the upcoming gate changes of the upstream's schedules.
+func (us *Upstream) Transitions(now time.Time) []Transition {
+	return upcomingTransitions(us.Id, us.Handler.schedules, now)
+}
+
+// evaluateSchedules closes the gate when a window starts and reopens it
+// when the window that closed it ends. A gate changed by anyone else in
+// the meantime is left alone.
+func (us *UpstreamHandler) evaluateSchedules(now time.Time) {
+	us.Lock()
+	defer us.Unlock()
+
+	for _, sc := range us.schedules {
+		id := sc.def.Id
+
+		active := sc.active(now)
+		if active == us.windows[id] {
+			continue
+		}
+		us.windows[id] = active
+
+		if active {
+			us.setGate(GateClosed, actorWithId(ActorSchedule, id), "scheduled window started", 0)
+			continue
+		}
+
+		if us.gate == nil || us.gate.Actor != actorWithId(ActorSchedule, id) {
+			continue
+		}
+
+		// another window may still be holding the gate
+		holder := ""
+		for other, on := range us.windows {
+			if on {
+				holder = other
+			}
+		}
+		if holder != "" {
+			us.gate.Actor = actorWithId(ActorSchedule, holder)
+			continue
+		}
+
+		us.setGate(GateOpened, actorWithId(ActorSchedule, id), "scheduled window ended", 0)
+	}
+}
+
 func (us *UpstreamHandler) run() {
 	var tick *time.Ticker
 	if us.def.Interval == 0 {
 		tick = time.NewTicker(DefaultIntervalPing)
 	} else {
-		tick = time.NewTicker(time.Duration(us.def.Interval) * time.Millisecond)
+		tick = time.NewTicker(time.Duration(us.def.Interval))
 	}
 	defer tick.Stop()
 
+	var scheduleC <-chan time.Time
+	if len(us.schedules) > 0 {
+		us.evaluateSchedules(time.Now())
+
+		st := time.NewTicker(ScheduleTick)
+		defer st.Stop()
+		scheduleC = st.C
+	}
+
 	cnt := 0
 	for {
 		select {
@@ -110,6 +258,9 @@ func (us *UpstreamHandler) run() {
 			log.Printf("[upstream:%s] cancelled\n", us.def.Id)
 			return
 
+		case now := <-scheduleC:
+			us.evaluateSchedules(now)
+
 		case <-tick.C:
 			cnt++
 
@@ -121,7 +272,7 @@ func (us *UpstreamHandler) run() {
 				_s := us.GetUpstreamStatus()
 				if _s == StatusNone || _s == StatusAvailable {
 					log.Printf("[upstream:%s/%d] Switch to 'Unavailable'\n", us.def.Id, cnt)
-					us.notify(`{"status":"change". "desc":"upstream [` + us.def.Id + `] unavailable"}`)
+					us.notify(`{"status":"change", "desc":"upstream [` + us.def.Id + `] unavailable"}`)
 				}
 				us.UpdateUpstreamStatus(StatusUnavailable)
 				continue
@@ -131,7 +282,7 @@ func (us *UpstreamHandler) run() {
 			_s := us.GetUpstreamStatus()
 			if _s == StatusNone || _s == StatusUnavailable {
 				log.Printf("[upstream:%s/%d] Switch to 'Available'\n", us.def.Id, cnt)
-				us.notify(`{"status":"change". "desc":"upstream [` + us.def.Id + `] available"}`)
+				us.notify(`{"status":"change", "desc":"upstream [` + us.def.Id + `] available"}`)
 			}
 
 			us.UpdateUpstreamStatus(StatusAvailable)
@@ -140,11 +291,49 @@ func (us *UpstreamHandler) run() {
 }
 
 func (us *UpstreamHandler) UpdateUpstreamStatus(s uint32) {
-	atomic.StoreUint32(&us.UpstreamStatus, s)
+	if atomic.SwapUint32(&us.UpstreamStatus, s) == s {
+		return
+	}
+	us.updateReady()
+	us.broadcast()
 }
 
 func (us *UpstreamHandler) UpdateGate(g uint32) {
-	atomic.StoreUint32(&us.GateState, g)
+	if atomic.SwapUint32(&us.GateState, g) == g {
+		return
+	}
+	us.updateReady()
+	us.broadcast()
+}
+
+// watch returns a channel closed on the next change of the upstream.
+func (us *UpstreamHandler) watch() <-chan struct{} {
+	us.watchLock.Lock()
+	defer us.watchLock.Unlock()
+
+	if us.changed == nil {
+		us.changed = make(chan struct{})
+	}
+	return us.changed
+}
+
+// broadcast wakes up everyone watching the upstream.
+func (us *UpstreamHandler) broadcast() {
+	us.watchLock.Lock()
+	defer us.watchLock.Unlock()
+
+	if us.changed != nil {
+		close(us.changed)
+		us.changed = nil
+	}
+}
+
+// done frees the in-flight slot taken by admit.
+func (us *UpstreamHandler) done() {
+	atomic.AddInt32(&us.InFlight, -1)
+	if us.release != nil && us.release.def.MaxConcurrent > 0 || us.breaker != nil {
+		us.broadcast()
+	}
 }
 
 func (us *UpstreamHandler) GetUpstreamStatus() uint32 {
@@ -155,33 +344,54 @@ func (us *UpstreamHandler) GetGateState() uint32 {
 	return atomic.LoadUint32(&us.GateState)
 }
 
+func (us *UpstreamHandler) MarshalJSON() ([]byte, error) {
+	gate := us.GateInfo()
+
+	return json.Marshal(struct {
+		UpstreamStatus uint32       `json:"upstream_status"`
+		GateState      uint32       `json:"gate_state"`
+		InFlight       int32        `json:"in_flight"`
+		Gate           GateChange   `json:"gate"`
+		Release        *ReleaseInfo `json:"release,omitempty"`
+		Breaker        *BreakerInfo `json:"breaker,omitempty"`
+	}{
+		UpstreamStatus: us.GetUpstreamStatus(),
+		GateState:      us.GetGateState(),
+		InFlight:       us.GetInFlight(),
+		Gate:           gate,
+		Release:        us.ReleaseInfo(),
+		Breaker:        us.BreakerInfo(),
+	})
+}
+
+func (us *UpstreamHandler) GetInFlight() int32 {
+	return atomic.LoadInt32(&us.InFlight)
+}
+
 func (us *UpstreamHandler) notify(msg string) {
 	if len(us.notiC) < cap(us.notiC) {
 		us.notiC <- msg
 	}
 }
 
-func (up *Upstream) CreateReverseProxy(mode string, timeout int) error {
+// CreateReverseProxy creates the reverse proxy of the upstream, shared by
+// its endpoints; their settings, e.g. the proxy mode, are read per request.
+func (up *Upstream) CreateReverseProxy() error {
+	if up.Handler.revproxy != nil {
+		return nil
+	}
+
 	upURL, err := url.Parse(up.Def.Endpoint)
 	if err != nil {
 		return err
 	}
 
-	switch mode {
-	case ProxyModeStoreAndForward:
-	case ProxyModeBypass:
-	default:
-		return errors.New("invalid proxy mode")
-	}
-
 	up.Handler.revproxy = httputil.NewSingleHostReverseProxy(upURL)
 	up.Handler.revproxy.Transport = &MyTransport{
-		upstream:          up.Id,
-		mode:              mode,
-		timeout:           timeout,
-		interval:          up.Def.Interval,
-		getUpstreamStatus: up.Handler.GetUpstreamStatus,
-		getGateState:      up.Handler.GetGateState,
+		upstream: up.Id,
+		interval: time.Duration(up.Def.Interval),
+		notify:   up.Handler.notify,
+		metrics:  metricsFromContext(up.Handler.ctx),
 	}
 	// up.Handler.revproxy.ErrorHandler = func(http.ResponseWriter, *http.Request, error) {
 	// }
@@ -190,6 +400,6 @@ func (up *Upstream) CreateReverseProxy(mode string, timeout int) error {
 }
 
 func (up *Upstream) Forward(w http.ResponseWriter, r *http.Request) {
-	r.Header.Add("X-Buffy-Upstream-ID", up.Def.Id)
+	r.Header.Set("X-Buffy-Upstream-ID", up.Def.Id)
 	up.Handler.revproxy.ServeHTTP(w, r)
 }